@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/target/impeller/utils/encryption"
+
+	"github.com/urfave/cli"
+)
+
+var encryptCommand = cli.Command{
+	Name:      "encrypt",
+	Usage:     "Encrypt the values of values files with the key in " + encryption.KeyEnv + " or " + encryption.KeyFileEnv,
+	ArgsUsage: "[values files...]",
+	Action:    runEncrypt,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "in-place, i",
+			Usage: "Replace the files instead of printing the result",
+		},
+		cli.BoolFlag{
+			Name:  "generate-key",
+			Usage: "Print a new random key and exit",
+		},
+	},
+}
+
+var decryptCommand = cli.Command{
+	Name:      "decrypt",
+	Usage:     "Decrypt the values of values files with the key in " + encryption.KeyEnv + " or " + encryption.KeyFileEnv,
+	ArgsUsage: "[values files...]",
+	Action:    runDecrypt,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "in-place, i",
+			Usage: "Replace the files instead of printing the result",
+		},
+	},
+}
+
+func runEncrypt(ctx *cli.Context) error {
+	if ctx.Bool("generate-key") {
+		key, err := encryption.GenerateKey()
+		if err != nil {
+			return fmt.Errorf("Error generating key: %v", err)
+		}
+		fmt.Println(key)
+		return nil
+	}
+	return transformFiles(ctx, encryption.Encrypt, false)
+}
+
+func runDecrypt(ctx *cli.Context) error {
+	return transformFiles(ctx, encryption.Decrypt, true)
+}
+
+// transformFiles encrypts or decrypts the files given as arguments and
+// prints the result, or replaces the files with --in-place. Decrypted files
+// are made readable only by the current user.
+func transformFiles(ctx *cli.Context, transform func(data, key []byte) ([]byte, error), decrypt bool) error {
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("no values files given")
+	}
+	key, err := encryption.LoadKey()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range ctx.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out, err := transform(data, key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if !ctx.Bool("in-place") {
+			os.Stdout.Write(out)
+			continue
+		}
+		if decrypt {
+			// Restrict the file before the plaintext is written to it.
+			if err := os.Chmod(path, 0600); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(path, out, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/target/impeller/utils/encryption"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+func TestDecryptInPlaceRestrictsMode(t *testing.T) {
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	t.Setenv(encryption.KeyEnv, key)
+	decoded, err := encryption.LoadKey()
+	require.NoError(t, err)
+
+	encrypted, err := encryption.Encrypt([]byte("password: hunter2\n"), decoded)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "secret.yaml")
+	require.NoError(t, os.WriteFile(path, encrypted, 0o644))
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{decryptCommand}
+	require.NoError(t, app.Run([]string{"impeller", "decrypt", "--in-place", path}))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "password: hunter2\n", string(data))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/target/impeller/types"
+	"github.com/target/impeller/utils"
+)
+
+// Fleet deploys several clusters concurrently. Every cluster is deployed by
+// its own copy of Plugin with a private kubeconfig and Helm repository state.
+type Fleet struct {
+	// Plugin holds the settings shared by all clusters, e.g. kubeconfig,
+	// value files and dry-run mode.
+	Plugin             Plugin
+	Config             types.FleetConfig
+	ClusterConfigFiles []string
+}
+
+type fleetResult struct {
+	Cluster     string
+	File        string
+	KubeContext string
+	Duration    time.Duration
+	Err         error
+}
+
+// Exec deploys all clusters and prints a summary table to stdout. An error
+// is returned if any cluster failed.
+func (f *Fleet) Exec() error {
+	if len(f.ClusterConfigFiles) == 0 {
+		return fmt.Errorf("no cluster config files found")
+	}
+
+	parallelism := f.Config.Parallelism
+	if parallelism <= 0 {
+		parallelism = len(f.ClusterConfigFiles)
+	}
+	f.Plugin.log().Printf("Deploying %d clusters with parallelism %d", len(f.ClusterConfigFiles), parallelism)
+
+	results := make([]fleetResult, len(f.ClusterConfigFiles))
+	semaphore := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, file := range f.ClusterConfigFiles {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = f.deployCluster(file)
+		}(i, file)
+	}
+	wg.Wait()
+
+	writeFleetSummary(os.Stdout, results)
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clusters failed", failed, len(results))
+	}
+	return nil
+}
+
+func (f *Fleet) deployCluster(file string) (result fleetResult) {
+	start := time.Now()
+	result.File = file
+	result.Cluster = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	defer func() { result.Duration = time.Since(start) }()
+
+	clusterConfig, err := utils.ReadClusterConfig(file)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading cluster config: %v", err)
+		return
+	}
+	if clusterConfig.Name != "" {
+		result.Cluster = clusterConfig.Name
+	}
+	result.KubeContext = f.Config.KubeContext(result.Cluster)
+
+	p := f.Plugin.withLogPrefix(fmt.Sprintf("[%s] ", result.Cluster))
+	defer p.flushOutput()
+	p.ClusterConfig = clusterConfig
+	p.ClusterConfigPath = file
+	p.KubeContext = result.KubeContext
+
+	p.stateDir, err = os.MkdirTemp("", "impeller-"+result.Cluster+"-")
+	if err != nil {
+		result.Err = fmt.Errorf("error creating state directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(p.stateDir)
+
+	// Clusters relying on repos set up by a previous run keep using the
+	// shared Helm repository state.
+	if !clusterConfig.Helm.SkipSetupHelmRepo {
+		p.setEnv("HELM_REPOSITORY_CONFIG", filepath.Join(p.stateDir, "repositories.yaml"))
+		p.setEnv("HELM_REPOSITORY_CACHE", filepath.Join(p.stateDir, "repository-cache"))
+	}
+
+	p.log().Printf("Deploying cluster %s from %s with context %s", result.Cluster, file, result.KubeContext)
+	result.Err = p.Exec()
+	return
+}
+
+func writeFleetSummary(w io.Writer, results []fleetResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tCONTEXT\tSTATUS\tDURATION\tERROR")
+	for _, result := range results {
+		status, message := "SUCCESS", ""
+		if result.Err != nil {
+			status, message = "FAILED", strings.ReplaceAll(result.Err.Error(), "\n", " ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Cluster, result.KubeContext, status, result.Duration.Round(time.Second), message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/target/impeller/types"
+)
+
+func TestFleetExec(t *testing.T) {
+	tempDir := t.TempDir()
+	good := filepath.Join(tempDir, "good.yaml")
+	broken := filepath.Join(tempDir, "broken.yaml")
+	require.NoError(t, os.WriteFile(good, []byte("name: good-cluster\nhelm:\n  skipSetupKubeConfig: true\n  skipSetupHelmRepo: true\n"), 0o644))
+	require.NoError(t, os.WriteFile(broken, []byte("name: [broken"), 0o644))
+
+	fleet := Fleet{
+		Config: types.FleetConfig{
+			Clusters: []types.FleetCluster{{Name: "good-cluster", KubeContext: "good-context"}},
+		},
+		ClusterConfigFiles: []string{good, broken},
+	}
+
+	err := fleet.Exec()
+	require.Error(t, err)
+	assert.Equal(t, "1 of 2 clusters failed", err.Error())
+}
+
+func TestFleetExecNoClusters(t *testing.T) {
+	fleet := Fleet{}
+	err := fleet.Exec()
+	require.Error(t, err)
+}
+
+func TestWriteFleetSummary(t *testing.T) {
+	var out bytes.Buffer
+	writeFleetSummary(&out, []fleetResult{
+		{Cluster: "cluster1-lab", KubeContext: "lab", Duration: 2 * time.Second},
+		{Cluster: "cluster1-prod", KubeContext: "prod", Duration: time.Second, Err: fmt.Errorf("error installing addon")},
+	})
+
+	assert.Equal(t, ""+
+		"CLUSTER        CONTEXT  STATUS   DURATION  ERROR\n"+
+		"cluster1-lab   lab      SUCCESS  2s        \n"+
+		"cluster1-prod  prod     FAILED   1s        error installing addon\n", out.String())
+}
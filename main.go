@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/target/impeller/types"
 	"github.com/target/impeller/utils"
@@ -16,12 +17,23 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "addon-manager"
 	app.Action = run
+	app.Commands = []cli.Command{
+		validateCommand,
+		schemaCommand,
+		encryptCommand,
+		decryptCommand,
+	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "cluster-config-path",
 			Usage:  "Path to the cluster config",
 			EnvVar: "CLUSTER_CONFIG,PLUGIN_CLUSTER_CONFIG,PARAMETER_CLUSTER_CONFIG",
 		},
+		cli.StringFlag{
+			Name:   "fleet-file",
+			Usage:  "Fleet file mapping clusters to Kubernetes contexts; deploys every cluster config in cluster-config-path",
+			EnvVar: "FLEET_FILE,PLUGIN_FLEET_FILE,PARAMETER_FLEET_FILE",
+		},
 		cli.StringSliceFlag{
 			Name:   "value-files",
 			Usage:  "Helm value override files",
@@ -52,6 +64,26 @@ func main() {
 			Usage:  "compares upgrade changes deployment",
 			EnvVar: "DIFF_RUN,PLUGIN_DIFF_RUN,PARAMETER_DIFF_RUN",
 		},
+		cli.IntFlag{
+			Name:   "parallelism",
+			Usage:  "Maximum number of releases installed concurrently",
+			EnvVar: "PARALLELISM,PLUGIN_PARALLELISM,PARAMETER_PARALLELISM",
+		},
+		cli.DurationFlag{
+			Name:   "wait-timeout",
+			Usage:  "Default time to wait for each resource to be ready, e.g. 10m; overrides helm.waitTimeout, overridden by waitTimeout of releases and waitFor entries",
+			EnvVar: "WAIT_TIMEOUT,PLUGIN_WAIT_TIMEOUT,PARAMETER_WAIT_TIMEOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "release",
+			Usage:  "Only handle the release with this name; can be repeated",
+			EnvVar: "RELEASES,PLUGIN_RELEASES,PARAMETER_RELEASES",
+		},
+		cli.StringFlag{
+			Name:   "selector",
+			Usage:  "Only handle releases whose labels match the selector, e.g. tier=infra,team!=data",
+			EnvVar: "SELECTOR,PLUGIN_SELECTOR,PARAMETER_SELECTOR",
+		},
 		cli.BoolFlag{
 			Name:   "audit",
 			Usage:  "create audit report",
@@ -83,7 +115,7 @@ func run(ctx *cli.Context) error {
 		if ctx.String("kube-config") == "" {
 			return fmt.Errorf("Kube config not set.")
 		}
-		if ctx.String("kube-context") == "" {
+		if ctx.String("kube-context") == "" && ctx.String("fleet-file") == "" {
 			return fmt.Errorf("Kube context not set.")
 		}
 	}
@@ -97,6 +129,8 @@ func run(ctx *cli.Context) error {
 		if err != nil {
 			return fmt.Errorf("Error reading cluster config: %v", err)
 		}
+	} else if ctx.String("fleet-file") != "" {
+		return runFleet(ctx)
 	} else {
 		clusterConfig, err = utils.ReadClusterConfig(ctx.String("cluster-config-path"))
 		if err != nil {
@@ -116,7 +150,40 @@ func run(ctx *cli.Context) error {
 		Diffrun:           ctx.Bool("diff-run"),
 		Audit:             ctx.Bool("audit"),
 		AuditFile:         auditReportFileName,
+		Parallelism:       ctx.Int("parallelism"),
+		WaitTimeout:       ctx.Duration("wait-timeout"),
+		ReleaseNames:      ctx.StringSlice("release"),
+		Selector:          ctx.String("selector"),
 	}
 
 	return plugin.Exec()
 }
+
+func runFleet(ctx *cli.Context) error {
+	fleetConfig, err := utils.ReadFleetConfig(ctx.String("fleet-file"))
+	if err != nil {
+		return fmt.Errorf("Error reading fleet file: %v", err)
+	}
+	files, err := utils.ListClusterConfigFiles(strings.Split(ctx.String("cluster-config-path"), ","))
+	if err != nil {
+		return fmt.Errorf("Error reading cluster config: %v", err)
+	}
+
+	fleet := Fleet{
+		Plugin: Plugin{
+			ValueFiles:       ctx.StringSlice("value-files"),
+			KubeConfig:       ctx.String("kube-config"),
+			KubeConfigBase64: ctx.Bool("kube-config-base64"),
+			Dryrun:           ctx.Bool("dry-run"),
+			Diffrun:          ctx.Bool("diff-run"),
+			Parallelism:      ctx.Int("parallelism"),
+			WaitTimeout:      ctx.Duration("wait-timeout"),
+			ReleaseNames:     ctx.StringSlice("release"),
+			Selector:         ctx.String("selector"),
+		},
+		Config:             fleetConfig,
+		ClusterConfigFiles: files,
+	}
+
+	return fleet.Exec()
+}
@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/target/impeller/constants"
 	"github.com/target/impeller/types"
 	"github.com/target/impeller/utils"
 	"github.com/target/impeller/utils/commandbuilder"
+	"github.com/target/impeller/utils/encryption"
+	"github.com/target/impeller/utils/readiness"
 	"github.com/target/impeller/utils/report"
 	"gopkg.in/yaml.v2"
 )
@@ -22,17 +35,23 @@ import (
 const (
 	kubectlBin = "kubectl"
 
-	maxRetriesDeployment   = 30
-	maxRetriesDaemonSet    = 30
-	maxRetriesStatefulSet  = 120
-	retryDelayDeployment   = 10 * time.Second
-	retryDelayDaemonSet    = 10 * time.Second
-	retryDelayStatefulSet  = 10 * time.Second
-	statefulSetLogInterval = 3
+	// Resources are waited for until they are ready for these durations
+	// unless configured otherwise.
+	defaultWaitTimeout            = 5 * time.Minute
+	defaultStatefulSetWaitTimeout = 20 * time.Minute
+	defaultPollInterval           = 10 * time.Second
+
+	// secretHashAnnotation holds the hash of the content of managed secrets,
+	// used to detect changes.
+	secretHashAnnotation = "impeller.target.com/content-hash"
 )
 
 var (
 	kubeConfig = os.Getenv("HOME") + "/.kube/config"
+
+	// downloadsMutex serializes chart downloads into ./downloads when
+	// releases are installed concurrently.
+	downloadsMutex sync.Mutex
 )
 
 type Plugin struct {
@@ -48,17 +67,54 @@ type Plugin struct {
 	Diffrun           bool
 	Audit             bool
 	AuditFile         string
+	Parallelism       int
+	WaitTimeout       time.Duration
+	ReleaseNames      []string
+	Selector          string
+
+	// logger, stdoutWriter and stderrWriter are set per release or cluster
+	// when they are installed concurrently so their output can be told apart.
+	logPrefix    string
+	logger       *log.Logger
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	// env holds additional environment variables for every executed
+	// command, e.g. KUBECONFIG.
+	env []string
+	// stateDir, if set, holds the kubeconfig and Helm repository state of
+	// this plugin so it does not share them with concurrent deployments.
+	stateDir string
+	// tempDir holds files written for a single run, e.g. inline values and
+	// decrypted values files, and is wiped when Exec returns.
+	tempDir string
 }
 
 func (p *Plugin) Exec() error {
 	if !p.Audit {
+		releases, err := releaseGraph(p.ClusterConfig.Releases)
+		if err != nil {
+			return fmt.Errorf("error resolving release dependencies: %v", err)
+		}
+		selected, err := p.selectReleases(p.ClusterConfig)
+		if err != nil {
+			return fmt.Errorf("error selecting releases: %v", err)
+		}
+		p.tempDir, err = ioutil.TempDir("", "impeller-")
+		if err != nil {
+			return fmt.Errorf("error creating temporary directory: %v", err)
+		}
+		defer func() {
+			if err := wipeDir(p.tempDir); err != nil {
+				p.log().Println("WARNING: Could not remove temporary files:", err)
+			}
+		}()
 		if !p.ClusterConfig.Helm.SkipSetupKubeConfig {
 			// Init Kubernetes config
 			if err := p.setupKubeconfig(); err != nil {
 				return fmt.Errorf("error initializing Kubernetes config: %v", err)
 			}
 		} else {
-			log.Println("Skipping setting up kubeconfig...")
+			p.log().Println("Skipping setting up kubeconfig...")
 		}
 		// Add configured repos
 		if !p.ClusterConfig.Helm.SkipSetupHelmRepo {
@@ -71,26 +127,54 @@ func (p *Plugin) Exec() error {
 				return fmt.Errorf("error updating Helm repos: %v", err)
 			}
 		} else {
-			log.Println("Skipping setting up Helm repos...")
+			p.log().Println("Skipping setting up Helm repos...")
 		}
 		if !p.ClusterConfig.Helm.SkipSetupKubeConfig {
 			// Install addons
-			for _, addon := range p.ClusterConfig.Releases {
-				if err := p.installAddon(&addon); err != nil {
-					return fmt.Errorf("error installing addon \"%s\": %v", addon.Name, err)
-				}
+			if err := p.installReleases(releases, selected); err != nil {
+				return err
 			}
 		}
 	} else {
-		log.Println("Generating Audit report:")
+		p.log().Println("Generating Audit report:")
 		rpt := report.NewReport()
 		for cluster := range p.ClustersList.ClusterList {
 			clusterConfig, err := utils.ReadClusterConfig(p.ClusterConfigPath + "/" + cluster)
 			if err != nil {
 				return fmt.Errorf("error reading cluster config: %v", err)
 			}
+			// Catalog definitions are interpolated with the vars of each
+			// cluster, so they are read per cluster.
+			catalog := map[string]types.Release{}
 
-			for _, addon := range clusterConfig.Releases {
+			selected, err := p.selectReleasesByFlags(clusterConfig.Releases)
+			if err != nil {
+				return fmt.Errorf("error selecting releases: %v", err)
+			}
+			for i, addon := range clusterConfig.Releases {
+				if !selected[i] {
+					continue
+				}
+				enabled, reason, err := releaseEnabled(clusterConfig, addon)
+				if err != nil {
+					return fmt.Errorf("error selecting releases: release \"%s\": %v", addon.Name, err)
+				}
+				status := "enabled"
+				if !enabled {
+					status = "skipped: " + reason
+				}
+				var divergence []string
+				if addon.From != "" {
+					if _, ok := catalog[addon.From]; !ok {
+						if catalog[addon.From], err = utils.ReadReleaseCatalog(clusterConfig, addon.From); err != nil {
+							return err
+						}
+					}
+					divergence = catalogDivergence(addon, catalog[addon.From])
+					if len(divergence) > 0 {
+						p.log().Printf("Release \"%s\" in cluster \"%s\" diverges from catalog \"%s\": %s", addon.Name, cluster, addon.From, strings.Join(divergence, ", "))
+					}
+				}
 				rpt.Add(report.ReportKey{
 					Name:      addon.Name,
 					Cluster:   cluster,
@@ -101,6 +185,9 @@ func (p *Plugin) Exec() error {
 					ChartPath:    addon.ChartPath,
 					ChartsSource: addon.ChartsSource,
 					ValueFiles:   utils.GetValueFiles(&addon.ValueFiles),
+					Status:       status,
+					Catalog:      addon.From,
+					Divergence:   strings.Join(divergence, ";"),
 				})
 			}
 		}
@@ -113,9 +200,88 @@ func (p *Plugin) Exec() error {
 	return nil
 }
 
+func (p *Plugin) log() *log.Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return log.Default()
+}
+
+func (p *Plugin) stdout() io.Writer {
+	if p.stdoutWriter != nil {
+		return p.stdoutWriter
+	}
+	return os.Stdout
+}
+
+func (p *Plugin) stderr() io.Writer {
+	if p.stderrWriter != nil {
+		return p.stderrWriter
+	}
+	return os.Stderr
+}
+
+// withLogPrefix returns a copy of p whose log lines and command output are
+// prefixed with prefix, in addition to any prefix p already has.
+func (p *Plugin) withLogPrefix(prefix string) *Plugin {
+	pp := *p
+	pp.logPrefix += prefix
+	pp.logger = log.New(os.Stderr, pp.logPrefix, log.LstdFlags|log.Lmsgprefix)
+	pp.stdoutWriter = utils.NewPrefixWriter(os.Stdout, pp.logPrefix)
+	pp.stderrWriter = utils.NewPrefixWriter(os.Stderr, pp.logPrefix)
+	return &pp
+}
+
+// flushOutput writes any partial output line left in prefixed writers.
+func (p *Plugin) flushOutput() {
+	for _, w := range []io.Writer{p.stdoutWriter, p.stderrWriter} {
+		if pw, ok := w.(*utils.PrefixWriter); ok {
+			pw.Flush()
+		}
+	}
+}
+
+// setEnv sets an environment variable for every command executed by p.
+func (p *Plugin) setEnv(name, value string) {
+	env := []string{}
+	for _, e := range p.env {
+		if !strings.HasPrefix(e, name+"=") {
+			env = append(env, e)
+		}
+	}
+	p.env = append(env, name+"="+value)
+}
+
+// command returns a CommandBuilder logging and writing its output through
+// the plugin's logger and writers.
+func (p *Plugin) command(name string) commandbuilder.CommandBuilder {
+	return commandbuilder.CommandBuilder{
+		Name:   name,
+		Logger: p.log(),
+		Stdout: p.stdout(),
+		Stderr: p.stderr(),
+		Env:    p.env,
+	}
+}
+
+// execCommand returns an exec.Cmd using the plugin's environment.
+func (p *Plugin) execCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if len(p.env) > 0 {
+		cmd.Env = append(os.Environ(), p.env...)
+	}
+	return cmd
+}
+
+func (p *Plugin) run(cmd *exec.Cmd, showCommand bool) error {
+	cmd.Stdout = p.stdout()
+	cmd.Stderr = p.stderr()
+	return utils.RunWithLogger(cmd, showCommand, p.log())
+}
+
 func (p *Plugin) addHelmRepo(repo types.HelmRepo) error {
-	log.Println("Adding Helm repo:", repo.Name)
-	cb := commandbuilder.CommandBuilder{Name: constants.HelmBin}
+	p.log().Println("Adding Helm repo:", repo.Name)
+	cb := p.command(constants.HelmBin)
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "repo"})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "add"})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: repo.Name})
@@ -154,16 +320,32 @@ func (p *Plugin) addHelmRepo(repo types.HelmRepo) error {
 }
 
 func (p *Plugin) updateHelmRepos() error {
-	log.Println("Updating Helm repos")
-	cmd := exec.Command(constants.HelmBin, "repo", "update")
-	if err := utils.Run(cmd, true); err != nil {
+	p.log().Println("Updating Helm repos")
+	cmd := p.execCommand(constants.HelmBin, "repo", "update")
+	if err := p.run(cmd, true); err != nil {
 		return fmt.Errorf("error updating helm repos: %v", err)
 	}
 	return nil
 }
 
 func (p *Plugin) installAddon(release *types.Release) error {
-	log.Println("Installing addon:", release.Name, "@", release.Version)
+	if !p.upgrade() && release.DeploymentMethod == "kubectl" {
+		// kubectl releases are not tracked by Helm, so it is unknown whether
+		// they exist; applying them would upgrade them.
+		return fmt.Errorf("helm.upgrade false is not supported for releases with deploymentMethod kubectl")
+	}
+	if !p.upgrade() {
+		exists, err := p.helmReleaseExists(release)
+		if err != nil {
+			return fmt.Errorf("error checking if release exists: %v", err)
+		}
+		if exists {
+			p.log().Printf("Skipping addon \"%s\": release already exists and helm.upgrade is false", release.Name)
+			return nil
+		}
+	}
+
+	p.log().Println("Installing addon:", release.Name, "@", release.Version)
 	var err error
 	switch release.DeploymentMethod {
 	case "kubectl":
@@ -188,7 +370,11 @@ func (p *Plugin) installAddon(release *types.Release) error {
 		return err
 	}
 
-	// Create/update configured secrets after core resources are ready.
+	// Create/update configured ConfigMaps and secrets after core resources
+	// are ready.
+	if err := p.applyConfigMaps(release); err != nil {
+		return err
+	}
 	if err := p.applySecrets(release); err != nil {
 		return err
 	}
@@ -198,9 +384,9 @@ func (p *Plugin) installAddon(release *types.Release) error {
 
 // installAddonViaHelm installs addons via helm upgrade --install RELEASE CHART
 func (p *Plugin) installAddonViaHelm(release *types.Release) error {
-	cb := commandbuilder.CommandBuilder{Name: constants.HelmBin}
+	cb := p.command(constants.HelmBin)
 	if p.Diffrun {
-		log.Println("Running Diff plugin:", release.Name)
+		p.log().Println("Running Diff plugin:", release.Name)
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "diff"})
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "upgrade"})
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--allow-unreleased"})
@@ -215,7 +401,7 @@ func (p *Plugin) installAddonViaHelm(release *types.Release) error {
 		}
 		// Force recreate resources if immutable fields change
 		if release.Force {
-			log.Println("Force flag enabled: will recreate resources with immutable field changes")
+			p.log().Println("Force flag enabled: will recreate resources with immutable field changes")
 			cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--force"})
 		}
 	}
@@ -227,6 +413,7 @@ func (p *Plugin) installAddonViaHelm(release *types.Release) error {
 	if p.ClusterConfig.Helm.Debug {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--debug"})
 	}
+	p.impersonate(&cb, release.Namespace)
 
 	// Add namespaces to command
 	if release.Namespace != "" {
@@ -241,7 +428,7 @@ func (p *Plugin) installAddonViaHelm(release *types.Release) error {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "v", Value: fmt.Sprint(p.ClusterConfig.Helm.LogLevel)})
 	}
 	if release.ChartsSource != "" {
-		log.Println("Charts Source defined for:", release.Name)
+		p.log().Println("Charts Source defined for:", release.Name)
 
 		_, err := p.downloadCharts(release)
 		if err != nil {
@@ -249,13 +436,16 @@ func (p *Plugin) installAddonViaHelm(release *types.Release) error {
 		}
 	}
 	// Add Overrides
-	for _, override := range p.overrides(release) {
-		cb.Add(override)
+	overrides, cleanup, err := p.overrides(release)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
+	cb.Add(overrides...)
 
 	// Dry Run
 	if p.Dryrun {
-		log.Println("Running Dry run:", release.Name)
+		p.log().Println("Running Dry run:", release.Name)
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--dry-run"})
 	}
 
@@ -275,22 +465,23 @@ func (p *Plugin) installAddonViaKubectl(release *types.Release) error {
 		return fmt.Errorf("error rendering chart for kubectl apply: %s", err)
 	}
 
-	cb := commandbuilder.CommandBuilder{Name: constants.KubectlBin}
+	cb := p.command(constants.KubectlBin)
 	// kubectl apply -f -
 	if release.Namespace != "" {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: release.Namespace})
 	}
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "context", Value: p.KubeContext})
+	p.impersonate(&cb, release.Namespace)
 	// Diff Run
 	if p.Diffrun {
-		log.Println("Running Diff run:", release.Name)
+		p.log().Println("Running Diff run:", release.Name)
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "diff"})
 	} else {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "apply"})
 	}
 	// Dry Run
 	if p.Dryrun {
-		log.Println("Running Dry run:", release.Name)
+		p.log().Println("Running Dry run:", release.Name)
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--dry-run=server"})
 	}
 
@@ -304,10 +495,10 @@ func (p *Plugin) installAddonViaKubectl(release *types.Release) error {
 	// independent components and the second run will install the ones
 	// that failed previously. If this command fails twice then the chart
 	// is just broken
-	if err := utils.Run(kubectlApplyCmd, false); err != nil && !(p.Diffrun && release.DeploymentMethod == "kubectl") {
+	if err := p.run(kubectlApplyCmd, false); err != nil && !(p.Diffrun && release.DeploymentMethod == "kubectl") {
 		kubectlApplyCmd := cb.Command()
 		kubectlApplyCmd.Stdin = strings.NewReader(renderedManifests)
-		return utils.Run(kubectlApplyCmd, false)
+		return p.run(kubectlApplyCmd, false)
 	}
 	return nil
 }
@@ -321,114 +512,281 @@ func (p *Plugin) waitForResources(release *types.Release) error {
 
 	// Wait for Deployments
 	for _, deployment := range release.WaitforDeployment {
-		log.Printf("Waiting for Deployment: %s", deployment)
-		if err := p.waitForResource("deployment", deployment, release.Namespace); err != nil {
-			return fmt.Errorf("error waiting for deployment \"%s\": %v", deployment, err)
+		p.log().Printf("Waiting for Deployment: %s", deployment.Name)
+		if err := p.waitForResource(release, deployment.WaitFor("deployment")); err != nil {
+			return fmt.Errorf("error waiting for deployment \"%s\": %v", deployment.Name, err)
 		}
 	}
 
 	// Wait for DaemonSets
 	for _, daemonset := range release.WaitforDaemonSet {
-		log.Printf("Waiting for DaemonSet: %s", daemonset)
-		if err := p.waitForResource("daemonset", daemonset, release.Namespace); err != nil {
-			return fmt.Errorf("error waiting for daemonset \"%s\": %v", daemonset, err)
+		p.log().Printf("Waiting for DaemonSet: %s", daemonset.Name)
+		if err := p.waitForResource(release, daemonset.WaitFor("daemonset")); err != nil {
+			return fmt.Errorf("error waiting for daemonset \"%s\": %v", daemonset.Name, err)
 		}
 	}
 
 	// Wait for StatefulSets
 	for _, statefulset := range release.WaitforStatefulSet {
-		log.Printf("Waiting for StatefulSet: %s", statefulset)
-		if err := p.waitForResource("statefulset", statefulset, release.Namespace); err != nil {
-			return fmt.Errorf("error waiting for statefulset \"%s\": %v", statefulset, err)
+		p.log().Printf("Waiting for StatefulSet: %s", statefulset.Name)
+		if err := p.waitForResource(release, statefulset.WaitFor("statefulset")); err != nil {
+			return fmt.Errorf("error waiting for statefulset \"%s\": %v", statefulset.Name, err)
+		}
+	}
+
+	// Wait for resources of any kind
+	waits := release.WaitFor
+	if release.WaitForAll {
+		manifests, err := p.templateChart(release)
+		if err != nil {
+			return fmt.Errorf("error rendering chart to find workloads: %v", err)
+		}
+		workloads, err := discoverWorkloads(release, manifests)
+		if err != nil {
+			return err
+		}
+		p.log().Printf("Found %d workload(s) to wait for in the chart", len(workloads))
+		waits = append(append([]types.WaitFor{}, waits...), workloads...)
+	}
+	for _, wait := range waits {
+		p.log().Printf("Waiting for %s: %s", wait.Kind, wait.Name)
+		if err := p.waitForResource(release, wait); err != nil {
+			return fmt.Errorf("error waiting for %s \"%s\": %v", wait.Kind, wait.Name, err)
 		}
 	}
 
 	return nil
 }
 
-// waitForResource checks if a resource is ready using polling (read-only operation)
-func (p *Plugin) waitForResource(resourceType, resourceName, namespace string) error {
-	switch resourceType {
-	case "deployment":
-		return p.waitForDeployment(resourceName, namespace)
-	case "daemonset":
-		return p.waitForDaemonSet(resourceName, namespace)
-	case "statefulset":
-		return p.waitForStatefulSet(resourceName, namespace)
-	default:
-		return fmt.Errorf("unsupported resource type: %s", resourceType)
+// discoveredKinds are the kinds waitForAll waits for.
+var discoveredKinds = map[string]bool{"Deployment": true, "StatefulSet": true, "DaemonSet": true, "Job": true}
+
+// discoverWorkloads returns the workloads in the rendered manifests of a
+// release which are not already waited for explicitly. Helm hooks are
+// skipped for Helm releases, as Helm runs and often deletes them itself.
+func discoverWorkloads(release *types.Release, manifests string) ([]types.WaitFor, error) {
+	waitKey := func(kind, name, namespace string) string {
+		if namespace == "" {
+			namespace = release.Namespace
+		}
+		return readiness.NormalizeKind(kind) + "/" + namespace + "/" + name
 	}
+	seen := map[string]bool{}
+	for kind, entries := range map[string][]types.WaitEntry{
+		"deployment":  release.WaitforDeployment,
+		"daemonset":   release.WaitforDaemonSet,
+		"statefulset": release.WaitforStatefulSet,
+	} {
+		for _, entry := range entries {
+			seen[waitKey(kind, entry.Name, "")] = true
+		}
+	}
+	for _, wait := range release.WaitFor {
+		seen[waitKey(wait.Kind, wait.Name, wait.Namespace)] = true
+	}
+
+	var workloads []types.WaitFor
+	decoder := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		var object struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Name        string            `yaml:"name"`
+				Namespace   string            `yaml:"namespace"`
+				Annotations map[string]string `yaml:"annotations"`
+			} `yaml:"metadata"`
+		}
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading rendered manifests: %v", err)
+		}
+		if !discoveredKinds[object.Kind] || object.Metadata.Name == "" {
+			continue
+		}
+		if _, hook := object.Metadata.Annotations["helm.sh/hook"]; hook && release.DeploymentMethod != "kubectl" {
+			continue
+		}
+		key := waitKey(object.Kind, object.Metadata.Name, object.Metadata.Namespace)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		workloads = append(workloads, types.WaitFor{
+			Kind:      strings.ToLower(object.Kind),
+			Name:      object.Metadata.Name,
+			Namespace: object.Metadata.Namespace,
+		})
+	}
+	return workloads, nil
 }
 
-func (p *Plugin) waitForDeployment(resourceName, namespace string) error {
-	log.Printf("⏳ Waiting for deployment %s/%s to be ready...", namespace, resourceName)
+// waitForResource waits for a resource of a release until it is ready or
+// its timeout is reached (read-only operation).
+func (p *Plugin) waitForResource(release *types.Release, wait types.WaitFor) error {
+	namespace := wait.Namespace
+	if namespace == "" {
+		namespace = release.Namespace
+	}
+	timeout, pollInterval, err := p.waitOptions(release, wait)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < maxRetriesDeployment; i++ {
-		output, err := p.kubectlGetJSONPath("deployment", resourceName, namespace, "{.status.conditions[?(@.type=='Available')].status}")
-		if err == nil && strings.TrimSpace(output) == "True" {
-			log.Printf("✅ Deployment %s/%s is ready", namespace, resourceName)
-			return nil
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.waitFor(ctx, wait.Kind, wait.Name, namespace, wait.Condition, pollInterval)
+}
 
-		if i < maxRetriesDeployment-1 {
-			time.Sleep(retryDelayDeployment)
+// waitOptions returns the timeout and poll interval of a wait, taken from
+// the wait entry, the release, --wait-timeout or the helm settings of the
+// cluster, whichever sets it first, and the defaults otherwise. Like
+// --parallelism, --wait-timeout overrides the cluster-wide setting.
+func (p *Plugin) waitOptions(release *types.Release, wait types.WaitFor) (timeout, pollInterval time.Duration, err error) {
+	for _, d := range []types.Duration{wait.Timeout, release.WaitTimeout} {
+		if timeout, err = d.Get(); err != nil || timeout > 0 {
+			break
+		}
+	}
+	if err == nil && timeout == 0 {
+		timeout = p.WaitTimeout
+	}
+	if err == nil && timeout == 0 {
+		timeout, err = p.ClusterConfig.Helm.WaitTimeout.Get()
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("wait timeout: %v", err)
+	}
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+		if readiness.NormalizeKind(wait.Kind) == "statefulset" {
+			timeout = defaultStatefulSetWaitTimeout
 		}
 	}
 
-	return fmt.Errorf("timeout waiting for deployment %s/%s", namespace, resourceName)
+	for _, d := range []types.Duration{wait.PollInterval, release.PollInterval, p.ClusterConfig.Helm.PollInterval} {
+		if pollInterval, err = d.Get(); err != nil || pollInterval > 0 {
+			break
+		}
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("poll interval: %v", err)
+	}
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	return timeout, pollInterval, nil
 }
 
-func (p *Plugin) waitForDaemonSet(resourceName, namespace string) error {
-	log.Printf("⏳ Waiting for daemonset %s/%s to be ready...", namespace, resourceName)
+// waitFor polls a resource of any kind until it is ready according to the
+// readiness rule of its kind, or the condition if set, or ctx is done.
+// Resources which do not exist yet are waited for as well, while other
+// kubectl errors, e.g. an unknown kind or a forbidden read, fail right away.
+func (p *Plugin) waitFor(ctx context.Context, kind, name, namespace, condition string, pollInterval time.Duration) error {
+	p.log().Printf("⏳ Waiting for %s %s/%s to be ready...", kind, namespace, name)
+	if deadline, ok := ctx.Deadline(); ok {
+		p.log().Printf("  (This may take up to %s)", time.Until(deadline).Round(time.Second))
+	}
 
-	for i := 0; i < maxRetriesDaemonSet; i++ {
-		output, err := p.kubectlGetJSONPath("daemonset", resourceName, namespace, "{.status.numberReady},{.status.desiredNumberScheduled}")
+	start := time.Now()
+	var message string
+	for {
+		object, err := p.kubectlGetJSON(ctx, kind, name, namespace)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
 		if err == nil {
-			parts := strings.Split(strings.TrimSpace(output), ",")
-			if len(parts) == 2 && parts[0] == parts[1] && parts[0] != "0" {
-				log.Printf("✅ DaemonSet %s/%s is ready", namespace, resourceName)
+			status := readiness.Status{Message: "not found"}
+			if object != nil {
+				if status, err = readiness.Check(kind, object, condition); err != nil {
+					return err
+				}
+			}
+			if status.Ready {
+				p.log().Printf("✅ %s %s/%s is ready", kind, namespace, name)
 				return nil
 			}
+			if object != nil && condition == "" && readiness.HasPods(kind) {
+				if err := p.checkPods(ctx, kind, object, namespace); err != nil {
+					return err
+				}
+			}
+			if status.Message != message {
+				message = status.Message
+				p.log().Printf("  Progress: %s", message)
+			}
 		}
 
-		if i < maxRetriesDaemonSet-1 {
-			time.Sleep(retryDelayDaemonSet)
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("timeout waiting for %s %s/%s after %s", kind, namespace, name, time.Since(start).Round(time.Second))
+			if message != "" {
+				err = fmt.Errorf("%v: %s", err, message)
+			}
+			return err
+		case <-time.After(pollInterval):
 		}
 	}
-
-	return fmt.Errorf("timeout waiting for daemonset %s/%s", namespace, resourceName)
 }
 
-func (p *Plugin) waitForStatefulSet(resourceName, namespace string) error {
-	log.Printf("⏳ Waiting for statefulset %s/%s to be ready...", namespace, resourceName)
-	log.Printf("  (This may take up to %d minutes for larger clusters)", maxRetriesStatefulSet*int(retryDelayStatefulSet.Seconds())/60)
-
-	for i := 0; i < maxRetriesStatefulSet; i++ {
-		output, err := p.kubectlGetJSONPath("statefulset", resourceName, namespace, "{.status.readyReplicas},{.status.replicas}")
-		if err == nil {
-			parts := strings.Split(strings.TrimSpace(output), ",")
-			if len(parts) == 2 && parts[0] == parts[1] && parts[0] != "0" {
-				log.Printf("✅ StatefulSet %s/%s is ready (%s/%s replicas)", namespace, resourceName, parts[0], parts[1])
-				return nil
-			}
-			if len(parts) == 2 && i%statefulSetLogInterval == 0 {
-				log.Printf("  Progress: %s/%s replicas ready (attempt %d/%d)", parts[0], parts[1], i+1, maxRetriesStatefulSet)
-			}
+// checkPods fails if a pod of the current revision of a workload is
+// broken, e.g. its image cannot be pulled or it keeps crashing, so waits
+// fail right away instead of at the timeout. Pods which cannot be read are
+// checked again on the next poll.
+func (p *Plugin) checkPods(ctx context.Context, kind string, object map[string]interface{}, namespace string) error {
+	selector, err := readiness.Selector(object)
+	if err != nil {
+		return nil
+	}
+	pods, err := p.kubectlListJSON(ctx, "pods", namespace, selector)
+	if err != nil {
+		return nil
+	}
+	var templateHash string
+	if readiness.NormalizeKind(kind) == "deployment" {
+		replicaSets, err := p.kubectlListJSON(ctx, "replicasets", namespace, selector)
+		if err != nil {
+			return nil
 		}
+		templateHash = readiness.DeploymentTemplateHash(object, replicaSets)
+	}
 
-		if i < maxRetriesStatefulSet-1 {
-			time.Sleep(retryDelayStatefulSet)
+	for _, pod := range readiness.CurrentPods(kind, object, pods, templateHash) {
+		if err := readiness.CheckPod(pod); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// kubectlGetJSON returns a resource as decoded by kubectl get -o json, or
+// nil if it does not exist.
+func (p *Plugin) kubectlGetJSON(ctx context.Context, resourceType, resourceName, namespace string) (map[string]interface{}, error) {
+	var object map[string]interface{}
+	err := p.kubectlGet(ctx, namespace, &object, resourceType, resourceName, "--ignore-not-found")
+	return object, err
+}
 
-	return fmt.Errorf("timeout waiting for statefulset %s/%s after %d minutes", namespace, resourceName, maxRetriesStatefulSet*int(retryDelayStatefulSet.Seconds())/60)
+// kubectlListJSON returns the resources matching a label selector.
+func (p *Plugin) kubectlListJSON(ctx context.Context, resourceType, namespace, selector string) ([]map[string]interface{}, error) {
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	err := p.kubectlGet(ctx, namespace, &list, resourceType, "--selector", selector)
+	return list.Items, err
 }
 
-func (p *Plugin) kubectlGetJSONPath(resourceType, resourceName, namespace, jsonPath string) (string, error) {
-	cb := commandbuilder.CommandBuilder{Name: constants.KubectlBin}
+// kubectlGet runs kubectl get -o json with the given arguments and decodes
+// the output into out. Empty output, as printed with --ignore-not-found for
+// a missing resource, leaves out unchanged. Errors include kubectl's stderr.
+func (p *Plugin) kubectlGet(ctx context.Context, namespace string, out interface{}, args ...string) error {
+	cb := p.command(constants.KubectlBin)
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "get"})
-	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: resourceType})
-	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: resourceName})
+	for _, arg := range args {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: arg})
+	}
 
 	if namespace != "" {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: namespace})
@@ -437,15 +795,24 @@ func (p *Plugin) kubectlGetJSONPath(resourceType, resourceName, namespace, jsonP
 	if p.KubeContext != "" {
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "context", Value: p.KubeContext})
 	}
+	p.impersonate(&cb, namespace)
 
-	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "output", Value: fmt.Sprintf("jsonpath=%s", jsonPath)})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "output", Value: "json"})
 
-	output, err := cb.Command().Output()
+	output, err := cb.CommandContext(ctx).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+		return fmt.Errorf("error running kubectl get %s: %s", strings.Join(args, " "), bytes.TrimSpace(exitErr.Stderr))
+	}
 	if err != nil {
-		return "", err
+		return fmt.Errorf("error running kubectl get %s: %v", strings.Join(args, " "), err)
 	}
-
-	return string(output), nil
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(output, out); err != nil {
+		return fmt.Errorf("error decoding %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
 }
 
 // applyKubectlFiles applies additional kubectl manifest files after deployment
@@ -461,7 +828,7 @@ func (p *Plugin) applyKubectlFiles(release *types.Release) error {
 		return nil
 	}
 
-	log.Println("Applying additional kubectl files for:", release.Name)
+	p.log().Println("Applying additional kubectl files for:", release.Name)
 
 	for _, path := range release.KubectlFiles {
 		// Check if path is a file or directory
@@ -473,7 +840,7 @@ func (p *Plugin) applyKubectlFiles(release *types.Release) error {
 		var filesToApply []string
 		if fileInfo.IsDir() {
 			// If it's a directory, get all YAML files in it
-			log.Printf("Processing directory: %s", path)
+			p.log().Printf("Processing directory: %s", path)
 			files, err := p.getYAMLFilesFromDir(path)
 			if err != nil {
 				return fmt.Errorf("error reading directory \"%s\": %v", path, err)
@@ -486,9 +853,9 @@ func (p *Plugin) applyKubectlFiles(release *types.Release) error {
 
 		// Apply each file
 		for _, file := range filesToApply {
-			log.Printf("Applying kubectl file: %s", file)
+			p.log().Printf("Applying kubectl file: %s", file)
 
-			cb := commandbuilder.CommandBuilder{Name: constants.KubectlBin}
+			cb := p.command(constants.KubectlBin)
 			cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "apply"})
 			cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "filename", Value: file})
 
@@ -498,12 +865,13 @@ func (p *Plugin) applyKubectlFiles(release *types.Release) error {
 			if p.KubeContext != "" {
 				cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "context", Value: p.KubeContext})
 			}
+			p.impersonate(&cb, release.Namespace)
 
 			if err := cb.Run(); err != nil {
 				return fmt.Errorf("error applying kubectl file \"%s\": %v", file, err)
 			}
 
-			log.Printf("Successfully applied kubectl file: %s", file)
+			p.log().Printf("Successfully applied kubectl file: %s", file)
 		}
 	}
 
@@ -530,7 +898,7 @@ func (p *Plugin) getYAMLFilesFromDir(dirPath string) ([]string, error) {
 		// Skip kustomization files
 		if fileName == "kustomization.yaml" || fileName == "Kustomization.yaml" ||
 			fileName == "kustomization.yml" || fileName == "Kustomization.yml" {
-			log.Printf("Skipping kustomization file: %s", fileName)
+			p.log().Printf("Skipping kustomization file: %s", fileName)
 			continue
 		}
 
@@ -541,9 +909,9 @@ func (p *Plugin) getYAMLFilesFromDir(dirPath string) ([]string, error) {
 	}
 
 	if len(yamlFiles) == 0 {
-		log.Printf("WARNING: No YAML files found in directory: %s", dirPath)
+		p.log().Printf("WARNING: No YAML files found in directory: %s", dirPath)
 	} else {
-		log.Printf("Found %d YAML file(s) in directory: %s", len(yamlFiles), dirPath)
+		p.log().Printf("Found %d YAML file(s) in directory: %s", len(yamlFiles), dirPath)
 	}
 
 	return yamlFiles, nil
@@ -555,87 +923,374 @@ func (p *Plugin) applySecrets(release *types.Release) error {
 	}
 
 	for _, secret := range release.Secrets {
-		if secret.Name == "" {
-			return fmt.Errorf("secret name cannot be empty for release %s", release.Name)
+		manifest, err := secretManifest(release, secret)
+		if err != nil {
+			return err
 		}
-		if len(secret.Data) == 0 {
-			return fmt.Errorf("secret %s has no data for release %s", secret.Name, release.Name)
+		metadata := manifest["metadata"].(map[string]interface{})
+		namespace, _ := metadata["namespace"].(string)
+		hash := metadata["annotations"].(map[string]string)[secretHashAnnotation]
+
+		// Only secrets restarting workloads are read, so releases not using
+		// restartOnChange do not need permission to get secrets.
+		changed := false
+		if len(secret.RestartOnChange) > 0 {
+			if changed, err = p.secretChanged(secret.Name, namespace, hash); err != nil {
+				return fmt.Errorf("error reading secret %q: %v", secret.Name, err)
+			}
 		}
-
-		namespace := secret.Namespace
-		if namespace == "" {
-			namespace = release.Namespace
+		if err := p.applyManifest(manifest); err != nil {
+			return fmt.Errorf("error applying secret %q: %v", secret.Name, err)
 		}
 
-		secretData := map[string]string{}
-		secretStringData := map[string]string{}
+		p.log().Printf("Applied secret: %s", secret.Name)
 
-		for key, envVarName := range secret.Data {
-			envVarName = strings.TrimSpace(envVarName)
-			if envVarName == "" {
-				return fmt.Errorf("secret %q key %q has empty environment variable name", secret.Name, key)
-			}
-			if !strings.HasSuffix(envVarName, "_ENV") {
-				return fmt.Errorf("secret %q key %q: value %q must be an environment variable name ending with _ENV", secret.Name, key, envVarName)
+		if changed {
+			p.log().Printf("Secret %s changed, restarting %s", secret.Name, strings.Join(secret.RestartOnChange, ", "))
+			if err := p.restartWorkloads(release, secret.RestartOnChange, namespace); err != nil {
+				return fmt.Errorf("error restarting workloads of secret %q: %v", secret.Name, err)
 			}
+		}
+	}
 
-			value, isSet := os.LookupEnv(envVarName)
-			if !isSet {
-				return fmt.Errorf("secret %q key %q requires environment variable %q to be set", secret.Name, key, envVarName)
-			}
-			if strings.TrimSpace(value) == "" {
-				return fmt.Errorf("secret %q key %q resolved empty value from environment variable %q", secret.Name, key, envVarName)
-			}
+	return nil
+}
 
-			if isBase64Encoded(value) {
-				secretData[key] = strings.TrimSpace(value)
-			} else {
-				secretStringData[key] = value
-			}
+// secretChanged reports whether an existing secret has different content
+// than the hash given. Secrets which do not exist yet are not changed, and
+// secrets without a hash annotation are assumed to have changed.
+func (p *Plugin) secretChanged(name, namespace, hash string) (bool, error) {
+	cb := p.command(constants.KubectlBin)
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "get"})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "secret"})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: name})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--ignore-not-found"})
+	if namespace != "" {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: namespace})
+	}
+	if p.KubeContext != "" {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "context", Value: p.KubeContext})
+	}
+	p.impersonate(&cb, namespace)
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "output", Value: `jsonpath={.metadata.name} {.metadata.annotations.impeller\.target\.com/content-hash}`})
+
+	output, err := cb.Command().Output()
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return false, nil
+	}
+	return len(fields) < 2 || fields[1] != hash, nil
+}
+
+// restartWorkloads restarts workloads such as deployment/my-app with
+// kubectl rollout restart and waits for them to be ready again.
+func (p *Plugin) restartWorkloads(release *types.Release, workloads []string, namespace string) error {
+	for _, workload := range workloads {
+		kind, name, err := types.ParseWorkload(workload)
+		if err != nil {
+			return err
 		}
 
-		metadata := map[string]string{"name": secret.Name}
+		cb := p.command(constants.KubectlBin)
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "rollout"})
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "restart"})
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: kind + "/" + name})
 		if namespace != "" {
-			metadata["namespace"] = namespace
+			cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: namespace})
+		}
+		if p.KubeContext != "" {
+			cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "context", Value: p.KubeContext})
+		}
+		p.impersonate(&cb, namespace)
+		if err := cb.Run(); err != nil {
+			return fmt.Errorf("could not restart %s: %v", workload, err)
 		}
 
-		secretManifestMap := map[string]interface{}{
-			"apiVersion": "v1",
-			"kind":       "Secret",
-			"metadata":   metadata,
-			"type":       "Opaque",
+		if err := p.waitForResource(release, types.WaitFor{Kind: kind, Name: name, Namespace: namespace}); err != nil {
+			return fmt.Errorf("error waiting for %s: %v", workload, err)
 		}
+	}
+	return nil
+}
 
-		if len(secretData) > 0 {
-			secretManifestMap["data"] = secretData
+// applyConfigMaps creates or updates the ConfigMaps of a release. On dry and
+// diff runs the manifests are printed instead, as they hold no secrets.
+func (p *Plugin) applyConfigMaps(release *types.Release) error {
+	for _, configMap := range release.ConfigMaps {
+		manifest, err := configMapManifest(release, configMap)
+		if err != nil {
+			return err
 		}
-		if len(secretStringData) > 0 {
-			secretManifestMap["stringData"] = secretStringData
+
+		if p.Dryrun || p.Diffrun {
+			out, err := yaml.Marshal(manifest)
+			if err != nil {
+				return fmt.Errorf("error preparing configmap %q manifest: %v", configMap.Name, err)
+			}
+			p.log().Printf("ConfigMap %s:\n%s", configMap.Name, out)
+			continue
 		}
 
-		secretManifest, err := yaml.Marshal(secretManifestMap)
+		if err := p.applyManifest(manifest); err != nil {
+			return fmt.Errorf("error applying configmap %q: %v", configMap.Name, err)
+		}
+		p.log().Printf("Applied configmap: %s", configMap.Name)
+	}
+	return nil
+}
+
+// applyManifest applies a single manifest with kubectl apply, passing it on
+// stdin so its content never ends up in a file or the process arguments.
+func (p *Plugin) applyManifest(manifest map[string]interface{}) error {
+	out, err := yaml.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error preparing manifest: %v", err)
+	}
+	namespace, _ := manifest["metadata"].(map[string]interface{})["namespace"].(string)
+
+	applyArgs := []string{"apply", "--filename", "-"}
+	if p.KubeContext != "" {
+		applyArgs = append(applyArgs, "--context", p.KubeContext)
+	}
+	if user := p.impersonatedUser(namespace); user != "" {
+		applyArgs = append(applyArgs, "--as", user)
+	}
+
+	applyCmd := p.execCommand(constants.KubectlBin, applyArgs...)
+	applyCmd.Stdin = strings.NewReader(string(out))
+	applyCmd.Stdout = p.stdout()
+	applyCmd.Stderr = p.stderr()
+	return applyCmd.Run()
+}
+
+// secretManifest builds the Secret manifest of a managed secret, resolving
+// its data from _ENV variables, value sources and registry credentials.
+func secretManifest(release *types.Release, secret types.Secret) (map[string]interface{}, error) {
+	if secret.Name == "" {
+		return nil, fmt.Errorf("secret name cannot be empty for release %s", release.Name)
+	}
+	if len(secret.Data) == 0 && len(secret.DataFrom) == 0 && secret.DockerRegistry == nil {
+		return nil, fmt.Errorf("secret %s has no data for release %s", secret.Name, release.Name)
+	}
+	if err := secret.Validate(); err != nil {
+		return nil, fmt.Errorf("secret %q: %v", secret.Name, err)
+	}
+
+	namespace := secret.Namespace
+	if namespace == "" {
+		namespace = release.Namespace
+	}
+
+	secretData := map[string]string{}
+	secretStringData := map[string]string{}
+
+	for key, envVarName := range secret.Data {
+		envVarName = strings.TrimSpace(envVarName)
+		if envVarName == "" {
+			return nil, fmt.Errorf("secret %q key %q has empty environment variable name", secret.Name, key)
+		}
+		if !strings.HasSuffix(envVarName, "_ENV") {
+			return nil, fmt.Errorf("secret %q key %q: value %q must be an environment variable name ending with _ENV", secret.Name, key, envVarName)
+		}
+
+		value, isSet := os.LookupEnv(envVarName)
+		if !isSet {
+			return nil, fmt.Errorf("secret %q key %q requires environment variable %q to be set", secret.Name, key, envVarName)
+		}
+		if strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("secret %q key %q resolved empty value from environment variable %q", secret.Name, key, envVarName)
+		}
+
+		if isBase64Encoded(value) {
+			secretData[key] = strings.TrimSpace(value)
+		} else {
+			secretStringData[key] = value
+		}
+	}
+
+	// Files are encoded so binary content such as keystores survives;
+	// values from other providers are used as-is.
+	for key, valueFrom := range secret.DataFrom {
+		value, err := valueFrom.GetValue()
 		if err != nil {
-			return fmt.Errorf("error preparing secret %q manifest: %v", secret.Name, err)
+			return nil, fmt.Errorf("secret %q key %q: %v", secret.Name, key, err)
 		}
+		if valueFrom.File != "" {
+			secretData[key] = base64.StdEncoding.EncodeToString([]byte(value))
+		} else {
+			secretStringData[key] = value
+		}
+	}
 
-		applyArgs := []string{"apply", "--filename", "-"}
-		if p.KubeContext != "" {
-			applyArgs = append(applyArgs, "--context", p.KubeContext)
+	if secret.DockerRegistry != nil {
+		config, err := secret.DockerRegistry.DockerConfigJSON()
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %v", secret.Name, err)
 		}
+		secretData[".dockerconfigjson"] = base64.StdEncoding.EncodeToString(config)
+	}
 
-		applyCmd := exec.Command(constants.KubectlBin, applyArgs...)
-		applyCmd.Stdin = strings.NewReader(string(secretManifest))
-		applyCmd.Stdout = os.Stdout
-		applyCmd.Stderr = os.Stderr
+	annotations := map[string]string{}
+	for key, value := range secret.Annotations {
+		annotations[key] = value
+	}
+	annotations[secretHashAnnotation] = secretHash(secret.SecretType(), secretData, secretStringData)
 
-		if err := applyCmd.Run(); err != nil {
-			return fmt.Errorf("error applying secret %q: %v", secret.Name, err)
+	metadata := map[string]interface{}{"name": secret.Name, "annotations": annotations}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if len(secret.Labels) > 0 {
+		metadata["labels"] = secret.Labels
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   metadata,
+		"type":       secret.SecretType(),
+	}
+	if secret.Immutable {
+		manifest["immutable"] = true
+	}
+	if len(secretData) > 0 {
+		manifest["data"] = secretData
+	}
+	if len(secretStringData) > 0 {
+		manifest["stringData"] = secretStringData
+	}
+	return manifest, nil
+}
+
+// secretHash returns the SHA-256 hash of the type and decoded data of a
+// secret. The hash does not depend on whether a value is set through data
+// or stringData.
+func secretHash(secretType string, data, stringData map[string]string) string {
+	values := map[string]string{}
+	for key, value := range data {
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			value = string(decoded)
 		}
+		values[key] = value
+	}
+	for key, value := range stringData {
+		values[key] = value
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		log.Printf("Applied secret: %s", secret.Name)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00", secretType)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s\x00%d\x00%s", key, len(values[key]), values[key])
 	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
 
-	return nil
+// configMapKeyPattern matches the keys Kubernetes accepts in ConfigMaps.
+var configMapKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// configMapManifest builds the ConfigMap manifest of a managed ConfigMap.
+// Files which are not valid UTF-8 are stored in binaryData.
+func configMapManifest(release *types.Release, configMap types.ConfigMap) (map[string]interface{}, error) {
+	if configMap.Name == "" {
+		return nil, fmt.Errorf("configmap name cannot be empty for release %s", release.Name)
+	}
+	if err := configMap.Validate(); err != nil {
+		return nil, fmt.Errorf("configmap %q: %v", configMap.Name, err)
+	}
+
+	namespace := configMap.Namespace
+	if namespace == "" {
+		namespace = release.Namespace
+	}
+
+	data := map[string]string{}
+	binaryData := map[string]string{}
+	add := func(key, value string) error {
+		if !configMapKeyPattern.MatchString(key) || len(key) > 253 {
+			return fmt.Errorf("configmap %q: invalid key %q", configMap.Name, key)
+		}
+		_, inData := data[key]
+		_, inBinaryData := binaryData[key]
+		if inData || inBinaryData {
+			return fmt.Errorf("configmap %q: key %q is set more than once", configMap.Name, key)
+		}
+		if utf8.ValidString(value) {
+			data[key] = value
+		} else {
+			binaryData[key] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		return nil
+	}
+
+	for key, value := range configMap.Data {
+		if err := add(key, value); err != nil {
+			return nil, err
+		}
+	}
+	for key, valueFrom := range configMap.DataFrom {
+		value, err := valueFrom.GetValue()
+		if err != nil {
+			return nil, fmt.Errorf("configmap %q key %q: %v", configMap.Name, key, err)
+		}
+		if err := add(key, value); err != nil {
+			return nil, err
+		}
+	}
+	// Like kubectl create configmap --from-file, every regular file of a
+	// directory becomes a key; subdirectories are ignored.
+	for _, dir := range configMap.Directories {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("configmap %q: %v", configMap.Name, err)
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("configmap %q: %v", configMap.Name, err)
+			}
+			if err := add(file.Name(), string(content)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	metadata := map[string]interface{}{"name": configMap.Name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if len(configMap.Labels) > 0 {
+		metadata["labels"] = configMap.Labels
+	}
+	if len(configMap.Annotations) > 0 {
+		metadata["annotations"] = configMap.Annotations
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   metadata,
+	}
+	if configMap.Immutable {
+		manifest["immutable"] = true
+	}
+	if len(data) > 0 {
+		manifest["data"] = data
+	}
+	if len(binaryData) > 0 {
+		manifest["binaryData"] = binaryData
+	}
+	return manifest, nil
 }
 
 func isBase64Encoded(value string) bool {
@@ -660,7 +1315,7 @@ func isBase64Encoded(value string) bool {
 }
 
 func (p *Plugin) fetchChart(release *types.Release) error {
-	cb := commandbuilder.CommandBuilder{Name: constants.HelmBin}
+	cb := p.command(constants.HelmBin)
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "fetch"})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "version", Value: release.Version})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--untar"})
@@ -669,6 +1324,8 @@ func (p *Plugin) fetchChart(release *types.Release) error {
 }
 
 func (p *Plugin) downloadCharts(release *types.Release) (string, error) {
+	downloadsMutex.Lock()
+	defer downloadsMutex.Unlock()
 
 	if _, err := os.Stat("./downloads"); os.IsNotExist(err) {
 		err := os.Mkdir("./downloads", 0755)
@@ -684,9 +1341,9 @@ func (p *Plugin) downloadCharts(release *types.Release) (string, error) {
 	tarFilePath := "./downloads/" + splits[len(splits)-1]
 
 	if _, err := os.Stat(tarFilePath); err != nil || os.IsExist(err) {
-		log.Println("Downloading:", tarFilePath)
-		cmd := exec.Command(constants.WgetBin, "-P", "./downloads", release.ChartsSource)
-		if err := utils.Run(cmd, true); err != nil {
+		p.log().Println("Downloading:", tarFilePath)
+		cmd := p.execCommand(constants.WgetBin, "-P", "./downloads", release.ChartsSource)
+		if err := p.run(cmd, true); err != nil {
 			return "", fmt.Errorf("error extracting Charts archive: %v", err)
 		}
 		err = p.extractCharts(tarFilePath)
@@ -694,30 +1351,39 @@ func (p *Plugin) downloadCharts(release *types.Release) (string, error) {
 			return tarFilePath, err
 		}
 	} else {
-		log.Println("File exist, skipping download:", tarFilePath)
+		p.log().Println("File exist, skipping download:", tarFilePath)
 	}
 	return tarFilePath, nil
 }
 
 func (p *Plugin) extractCharts(archiveName string) error {
-	cmd := exec.Command(constants.TarBin, "-xzf", archiveName, "-C", "./downloads")
-	if err := utils.Run(cmd, true); err != nil {
+	cmd := p.execCommand(constants.TarBin, "-xzf", archiveName, "-C", "./downloads")
+	if err := p.run(cmd, true); err != nil {
 		return fmt.Errorf("error extracting Charts archive: %v", err)
 	}
 	return nil
 }
 
+// templateChart renders a chart with helm template, with the same values as
+// an install and in the release namespace, so .Release.Namespace matches a
+// release installed with helm upgrade.
 func (p *Plugin) templateChart(release *types.Release) (string, error) {
 
-	cb := commandbuilder.CommandBuilder{Name: constants.HelmBin}
+	cb := p.command(constants.HelmBin)
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "template"})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: release.Name})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: release.ChartPath})
 	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "version", Value: release.Version})
+	if release.Namespace != "" {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: release.Namespace})
+	}
 	// Add Overrides
-	for _, override := range p.overrides(release) {
-		cb.Add(override)
+	overrides, cleanup, err := p.overrides(release)
+	if err != nil {
+		return "", err
 	}
+	defer cleanup()
+	cb.Add(overrides...)
 	cmd := cb.Command()
 	templateBytes, err := cmd.Output()
 	if err != nil {
@@ -732,92 +1398,414 @@ func (p *Plugin) setupKubeconfig() error {
 
 	if p.KubeConfig != "" {
 		p.KubeConfigFile = kubeConfig + "-" + p.KubeContext
-		log.Println("Creating Kubernetes configfile" + p.KubeConfigFile)
+		if p.stateDir != "" {
+			p.KubeConfigFile = filepath.Join(p.stateDir, "kubeconfig")
+		}
+		p.log().Println("Creating Kubernetes configfile" + p.KubeConfigFile)
 		if p.KubeConfigBase64 {
-			log.Println("configfile is base64 encoded")
+			p.log().Println("configfile is base64 encoded")
 			byteData, err = base64.StdEncoding.DecodeString(p.KubeConfig)
 			if err != nil {
-				log.Fatalf("err %v", err)
+				return fmt.Errorf("error decoding kube config: %v", err)
 			}
 
 		} else {
-			log.Println("configfile is not encoded")
+			p.log().Println("configfile is not encoded")
 			byteData = []byte(p.KubeConfig)
 		}
 
 		if err := ioutil.WriteFile(p.KubeConfigFile, byteData, 0600); err != nil {
 			return fmt.Errorf("error creating kube config file: %v", err)
 		}
-		log.Println("setting KUBECONFIG environment variable to:  " + p.KubeConfigFile)
-		err := os.Setenv("KUBECONFIG", p.KubeConfigFile)
-		if err != nil {
-			log.Fatalf("err %v", err)
+		p.log().Println("setting KUBECONFIG environment variable to:  " + p.KubeConfigFile)
+		if p.stateDir != "" {
+			p.setEnv("KUBECONFIG", p.KubeConfigFile)
+		} else if err := os.Setenv("KUBECONFIG", p.KubeConfigFile); err != nil {
+			return fmt.Errorf("error setting KUBECONFIG: %v", err)
+		}
+	} else if p.stateDir != "" {
+		// Switching the context must not affect concurrent deployments
+		// sharing the same kubeconfig, so work on a private copy.
+		if err := p.copyKubeconfig(); err != nil {
+			return fmt.Errorf("error copying kube config file: %v", err)
 		}
 	}
 
 	// Providing a Kubernetes config context is mostly used for Drone support.
 	// If not provided, the current context from Kubernetes config is used.
 	if p.KubeContext != "" {
-		log.Println("Setting Kubernetes context")
-		cb := commandbuilder.CommandBuilder{Name: kubectlBin}
+		p.log().Println("Setting Kubernetes context")
+		cb := p.command(kubectlBin)
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "config"})
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "use-context"})
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: p.KubeContext})
 		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "kubeconfig", Value: p.KubeConfigFile})
 		cmd := cb.Command()
-		if err := utils.Run(cmd, false); err != nil {
+		if err := p.run(cmd, false); err != nil {
 			return fmt.Errorf("error setting Kubernetes context: %v", err)
 		}
 	}
 	return nil
 }
 
-func (p *Plugin) overrides(release *types.Release) (args []commandbuilder.Arg) {
+// copyKubeconfig copies the current kubeconfig file into the plugin's state
+// directory and uses the copy for every command.
+func (p *Plugin) copyKubeconfig() error {
+	source := kubeConfig
+	if paths := filepath.SplitList(os.Getenv("KUBECONFIG")); len(paths) > 0 && paths[0] != "" {
+		source = paths[0]
+	}
+	byteData, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	p.KubeConfigFile = filepath.Join(p.stateDir, "kubeconfig")
+	if err := ioutil.WriteFile(p.KubeConfigFile, byteData, 0600); err != nil {
+		return err
+	}
+	p.log().Println("setting KUBECONFIG environment variable to:  " + p.KubeConfigFile)
+	p.setEnv("KUBECONFIG", p.KubeConfigFile)
+	return nil
+}
+
+// overrides returns the Helm arguments setting the values of a release. The
+// returned cleanup func wipes the decrypted values files and inline values
+// files written for them and must be called once the Helm command using
+// the arguments has run.
+func (p *Plugin) overrides(release *types.Release) (args []commandbuilder.Arg, cleanup func(), err error) {
+	var tempFiles []string
+	defer func() {
+		if err != nil {
+			p.wipeFiles(tempFiles)
+		}
+	}()
+
 	// Add override files
+	var files []string
 	for _, fileName := range p.ValueFiles {
-		log.Println("Adding override file:", fileName)
-		args = append(args, commandbuilder.Arg{
-			Type:  commandbuilder.ArgTypeShortParam,
-			Name:  "f",
-			Value: strings.TrimSpace(fileName)})
+		files = append(files, strings.TrimSpace(fileName))
 	}
-	path := fmt.Sprintf("values/%s/default.yaml", release.Name)
-	if _, err := os.Stat(path); err == nil {
-		log.Println("Adding override file:", path)
+	for _, path := range append(files, p.layeredValueFiles(release)...) {
+		p.log().Println("Adding override file:", path)
+		decrypted, err := p.decryptValuesFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if decrypted != path {
+			tempFiles = append(tempFiles, decrypted)
+		}
 		args = append(args, commandbuilder.Arg{
 			Type:  commandbuilder.ArgTypeShortParam,
 			Name:  "f",
-			Value: path})
+			Value: decrypted})
 	}
-	for _, path := range release.ValueFiles {
-		if _, err := os.Stat(path); err != nil {
-			log.Println("WARN: Value file does not exist:", path)
-			continue
+	// Inline values take precedence over values files
+	if len(release.Values) > 0 {
+		path, err := p.writeInlineValues(release)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error writing inline values: %v", err)
 		}
-		log.Println("Adding override file:", path)
+		tempFiles = append(tempFiles, path)
+		p.log().Println("Adding inline values file:", path)
 		args = append(args, commandbuilder.Arg{
 			Type:  commandbuilder.ArgTypeShortParam,
 			Name:  "f",
 			Value: path})
 	}
-	path = fmt.Sprintf("values/%s/%s.yaml", release.Name, p.ClusterConfig.Name)
-	if _, err := os.Stat(path); p.ClusterConfig.Name != "" && err == nil {
-		log.Println("Adding override file:", path)
+	// Cluster-wide value overrides come first so the release's own
+	// overrides take precedence.
+	keys := make([]string, 0, len(p.ClusterConfig.Helm.Overrides))
+	for key := range p.ClusterConfig.Helm.Overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.log().Println("Overriding cluster-wide value for:", key)
 		args = append(args, commandbuilder.Arg{
-			Type:  commandbuilder.ArgTypeShortParam,
-			Name:  "f",
-			Value: path})
+			Type:        commandbuilder.ArgTypeLongParam,
+			Name:        "set",
+			Value:       fmt.Sprintf("%s=%s", key, p.ClusterConfig.Helm.Overrides[key]),
+			ValueSecret: true,
+		})
 	}
 	// Handle individual value overrides
 	for _, override := range release.Overrides {
-		log.Println("Overriding value for:", override.Target)
+		p.log().Println("Overriding value for:", override.Target)
 		arg, err := override.BuildArg()
 		if err != nil {
-			log.Println("WARNING: Could not get override value. Skipping override:", err)
-			continue
+			return nil, nil, fmt.Errorf("error building override \"%s\": %v", override.Target, err)
 		}
 		args = append(args, *arg)
 	}
 
-	return args
+	return args, func() { p.wipeFiles(tempFiles) }, nil
+}
+
+// decryptValuesFile returns path if the values file is not encrypted.
+// Otherwise the file is decrypted into a new file, readable only by the
+// current user, in the plugin's temporary directory and its path is
+// returned.
+func (p *Plugin) decryptValuesFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !encryption.IsEncrypted(data) {
+		// Helm reports values files it cannot read.
+		return path, nil
+	}
+
+	p.log().Println("Decrypting values file:", path)
+	key, err := encryption.LoadKey()
+	if err != nil {
+		return "", fmt.Errorf("error decrypting values file \"%s\": %v", path, err)
+	}
+	decrypted, err := encryption.Decrypt(data, key)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting values file \"%s\": %v", path, err)
+	}
+
+	file, err := ioutil.TempFile(p.tempDir, "decrypted-*-"+filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := file.Chmod(0600); err != nil {
+		return "", err
+	}
+	if _, err := file.Write(decrypted); err != nil {
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// wipeFiles overwrites files with zeros and removes them. Failures are only
+// logged, as wipeDir removes the temporary directory at the end of the run.
+func (p *Plugin) wipeFiles(paths []string) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			err = wipeFile(path, info.Size())
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			p.log().Println("WARNING: Could not remove temporary file:", err)
+		}
+	}
+}
+
+// wipeDir overwrites every file in dir with zeros before removing dir, so
+// decrypted values do not linger on disk. Files are wiped as soon as they
+// are used, so this is a backstop for files left after a failure.
+func wipeDir(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return wipeFile(path, info.Size())
+	})
+	if removeErr := os.RemoveAll(dir); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// wipeFile overwrites the first size bytes of a file with zeros in place.
+// The file is not truncated first, which would free its blocks and leave
+// their content on disk.
+func wipeFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, size))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeInlineValues writes the inline values of a release to a new file,
+// readable only by the current user, in the plugin's temporary directory and
+// returns its path. In dry runs the values are logged, redacted.
+func (p *Plugin) writeInlineValues(release *types.Release) (string, error) {
+	data, err := yaml.Marshal(release.Values)
+	if err != nil {
+		return "", err
+	}
+	if p.Dryrun {
+		redacted, err := yaml.Marshal(redactValues(release.Values))
+		if err != nil {
+			return "", err
+		}
+		p.log().Printf("Inline values for %s:\n%s", release.Name, redacted)
+	}
+
+	file, err := ioutil.TempFile(p.tempDir, release.Name+"-values-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := file.Chmod(0600); err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// redactValues returns a copy of values with every scalar replaced, keeping
+// the structure of maps and lists.
+func redactValues(values interface{}) interface{} {
+	switch v := values.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			redacted[key] = redactValues(value)
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for key, value := range v {
+			redacted[key] = redactValues(value)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, value := range v {
+			redacted[i] = redactValues(value)
+		}
+		return redacted
+	case nil:
+		return nil
+	default:
+		return "[SECRET]"
+	}
+}
+
+// layeredValueFiles returns the existing values files of a release in the
+// order of the cluster's values layers:
+//
+//	default:    <valuesDir>/<release>/default.yaml
+//	valueFiles: the release's valueFiles
+//	groups:     <valuesDir>/<release>/<group>.yaml for each group in order
+//	cluster:    <valuesDir>/<release>/<cluster>.yaml
+//
+// Files of later layers take precedence.
+func (p *Plugin) layeredValueFiles(release *types.Release) (files []string) {
+	valuesDir := p.ClusterConfig.ValuesDir
+	if valuesDir == "" {
+		valuesDir = "values"
+	}
+	layerFile := func(name string) {
+		path := filepath.Join(valuesDir, release.Name, name+".yaml")
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	layers := p.ClusterConfig.ValuesLayers
+	if len(layers) == 0 {
+		layers = types.DefaultValuesLayers
+	}
+	for _, layer := range layers {
+		switch layer {
+		case "default":
+			layerFile("default")
+		case "valueFiles":
+			for _, path := range release.ValueFiles {
+				if _, err := os.Stat(path); err != nil {
+					p.log().Println("WARN: Value file does not exist:", path)
+					continue
+				}
+				files = append(files, path)
+			}
+		case "groups":
+			for _, group := range p.ClusterConfig.Groups {
+				layerFile(group)
+			}
+		case "cluster":
+			if p.ClusterConfig.Name != "" {
+				layerFile(p.ClusterConfig.Name)
+			}
+		default:
+			p.log().Printf("WARN: Unknown values layer \"%s\"", layer)
+		}
+	}
+	return files
+}
+
+// upgrade reports whether existing releases are upgraded. helm.upgrade
+// defaults to true; when it is false releases are only installed.
+func (p *Plugin) upgrade() bool {
+	return p.ClusterConfig.Helm.Upgrade == nil || *p.ClusterConfig.Helm.Upgrade
+}
+
+// helmReleaseExists reports whether a Helm release with the release's name
+// exists in its namespace, in any state.
+func (p *Plugin) helmReleaseExists(release *types.Release) (bool, error) {
+	cb := p.command(constants.HelmBin)
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "list"})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--all"})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeRaw, Value: "--short"})
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "filter", Value: "^" + regexp.QuoteMeta(release.Name) + "$"})
+	if release.Namespace != "" {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "namespace", Value: release.Namespace})
+	}
+	if p.KubeContext != "" {
+		cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "kube-context", Value: p.KubeContext})
+	}
+	p.impersonate(&cb, release.Namespace)
+
+	output, err := cb.Command().Output()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range strings.Fields(string(output)) {
+		if name == release.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// impersonatedUser returns the user Helm and kubectl impersonate for calls
+// concerning namespace, or "" if helm.serviceAccount is not set. The service
+// account is given as "namespace/name", or as "name" of a service account in
+// namespace. Values containing ":" are used as user name unchanged, e.g.
+// "system:serviceaccount:kube-system:deployer".
+func (p *Plugin) impersonatedUser(namespace string) string {
+	account := strings.TrimSpace(p.ClusterConfig.Helm.ServiceAccount)
+	switch {
+	case account == "":
+		return ""
+	case strings.Contains(account, ":"):
+		return account
+	case strings.Contains(account, "/"):
+		parts := strings.SplitN(account, "/", 2)
+		return fmt.Sprintf("system:serviceaccount:%s:%s", parts[0], parts[1])
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, account)
+}
+
+// impersonate makes a helm or kubectl command impersonate
+// helm.serviceAccount. kubectl gets --as; Helm gets HELM_KUBEASUSER, which
+// unlike --kube-as-user is also honoured by Helm plugins such as helm diff.
+func (p *Plugin) impersonate(cb *commandbuilder.CommandBuilder, namespace string) {
+	user := p.impersonatedUser(namespace)
+	if user == "" {
+		return
+	}
+	if cb.Name == constants.HelmBin {
+		p.log().Println("Impersonating:", user)
+		cb.Env = append(append([]string{}, cb.Env...), "HELM_KUBEASUSER="+user)
+		return
+	}
+	cb.Add(commandbuilder.Arg{Type: commandbuilder.ArgTypeLongParam, Name: "as", Value: user})
 }
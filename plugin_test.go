@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/target/impeller/constants"
 	"github.com/target/impeller/types"
 	"github.com/target/impeller/utils"
+	"github.com/target/impeller/utils/encryption"
 	"github.com/target/impeller/utils/report"
 )
 
@@ -19,7 +28,8 @@ func TestOverridesValueFiles(t *testing.T) {
 	}
 	release := &types.Release{}
 
-	overrides := p.overrides(release)
+	overrides, _, err := p.overrides(release)
+	require.NoError(t, err)
 	require.Len(t, overrides, 2)
 	assert.Equal(t, "test", overrides[0].Value)
 	assert.False(t, overrides[0].ValueSecret)
@@ -41,7 +51,8 @@ func TestOverridesIndividualOverrides(t *testing.T) {
 		},
 	}
 
-	overrides := p.overrides(release)
+	overrides, _, err := p.overrides(release)
+	require.NoError(t, err)
 	require.Len(t, overrides, 1)
 	assert.Equal(t, "set", overrides[0].Name)
 	assert.Equal(t, "image.tag=test", overrides[0].Value)
@@ -63,13 +74,247 @@ func TestOverridesIndividualOverridesPrint(t *testing.T) {
 		},
 	}
 
-	overrides := p.overrides(release)
+	overrides, _, err := p.overrides(release)
+	require.NoError(t, err)
 	require.Len(t, overrides, 1)
 	assert.Equal(t, "set", overrides[0].Name)
 	assert.Equal(t, "image.tag=test", overrides[0].Value)
 	assert.False(t, overrides[0].ValueSecret)
 }
 
+func TestOverridesClusterOverrides(t *testing.T) {
+	override := "release"
+	p := &Plugin{
+		ClusterConfig: types.ClusterConfig{
+			Helm: types.HelmConfig{
+				Overrides: map[string]string{"region": "us-east", "image.tag": "cluster"},
+			},
+		},
+	}
+	release := &types.Release{
+		Overrides: []types.Override{
+			{Target: "image.tag", Value: types.Value{Value: &override}},
+		},
+	}
+
+	overrides, _, err := p.overrides(release)
+	require.NoError(t, err)
+	require.Len(t, overrides, 3)
+	assert.Equal(t, "image.tag=cluster", overrides[0].Value)
+	assert.Equal(t, "region=us-east", overrides[1].Value)
+	// Helm uses the last --set of a value, so the release override wins.
+	assert.Equal(t, "image.tag=release", overrides[2].Value)
+}
+
+func TestOverridesInvalid(t *testing.T) {
+	replicas := "3"
+	p := &Plugin{}
+	t.Setenv("SERVERS_ENV", "not json")
+	for _, override := range []types.Override{
+		{Target: "replicas", Value: types.Value{Value: &replicas}, As: "number"},
+		{Target: "servers", Value: types.Value{ValueFrom: &types.ValueFrom{Environment: "SERVERS_ENV"}}, As: "json"},
+		{Target: "tls.key", Value: types.Value{ValueFrom: &types.ValueFrom{File: filepath.Join(t.TempDir(), "missing")}}, As: "string"},
+	} {
+		_, _, err := p.overrides(&types.Release{Name: "app", Overrides: []types.Override{override}})
+		require.Error(t, err, override.Target)
+		assert.Contains(t, err.Error(), `error building override "`+override.Target+`"`)
+	}
+}
+
+func TestOverridesInlineValues(t *testing.T) {
+	override := "test"
+	p := &Plugin{tempDir: t.TempDir()}
+	release := &types.Release{
+		Name: "app",
+		Values: map[string]interface{}{
+			"servers": []interface{}{
+				map[interface{}]interface{}{"zones": []interface{}{map[interface{}]interface{}{"zone": "us-east-1a"}}},
+			},
+		},
+		Overrides: []types.Override{{Target: "image.tag", Value: types.Value{Value: &override}}},
+	}
+
+	overrides, cleanup, err := p.overrides(release)
+	require.NoError(t, err)
+	require.Len(t, overrides, 2)
+	assert.Equal(t, "f", overrides[0].Name)
+	assert.Equal(t, p.tempDir, filepath.Dir(overrides[0].Value))
+	assert.Equal(t, "set", overrides[1].Name)
+
+	info, err := os.Stat(overrides[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := os.ReadFile(overrides[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "servers:\n- zones:\n  - zone: us-east-1a\n", string(data))
+
+	cleanup()
+	assert.NoFileExists(t, overrides[0].Value)
+}
+
+func TestRedactValues(t *testing.T) {
+	values := map[string]interface{}{
+		"password": "hunter2",
+		"replicas": 3,
+		"hosts":    []interface{}{"a", map[interface{}]interface{}{"name": "b"}},
+		"empty":    nil,
+	}
+	assert.Equal(t, map[string]interface{}{
+		"password": "[SECRET]",
+		"replicas": "[SECRET]",
+		"hosts":    []interface{}{"[SECRET]", map[interface{}]interface{}{"name": "[SECRET]"}},
+		"empty":    nil,
+	}, redactValues(values))
+}
+
+func TestOverridesEncryptedValueFiles(t *testing.T) {
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	t.Setenv(encryption.KeyEnv, key)
+	decoded, err := encryption.LoadKey()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.yaml")
+	require.NoError(t, os.WriteFile(plain, []byte("replicas: 1\n"), 0o644))
+	encrypted, err := encryption.Encrypt([]byte("password: hunter2\n"), decoded)
+	require.NoError(t, err)
+	secret := filepath.Join(dir, "secret.yaml")
+	require.NoError(t, os.WriteFile(secret, encrypted, 0o644))
+
+	p := &Plugin{ValueFiles: []string{plain, secret}, tempDir: t.TempDir()}
+	overrides, cleanup, err := p.overrides(&types.Release{Name: "app"})
+	require.NoError(t, err)
+	require.Len(t, overrides, 2)
+	assert.Equal(t, plain, overrides[0].Value)
+	assert.Equal(t, p.tempDir, filepath.Dir(overrides[1].Value))
+	info, err := os.Stat(overrides[1].Value)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := os.ReadFile(overrides[1].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "password: hunter2\n", string(data))
+
+	// Decrypted files are wiped once the command using them has run.
+	cleanup()
+	assert.NoFileExists(t, overrides[1].Value)
+	assert.FileExists(t, plain)
+
+	// They are wiped as well if a later override fails.
+	_, _, err = p.overrides(&types.Release{Name: "app", Overrides: []types.Override{{Target: "replicas", As: "number"}}})
+	require.Error(t, err)
+	entries, err := os.ReadDir(p.tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	require.NoError(t, wipeDir(p.tempDir))
+	assert.NoDirExists(t, p.tempDir)
+
+	t.Setenv(encryption.KeyEnv, "")
+	t.Setenv(encryption.KeyFileEnv, "")
+	_, _, err = p.overrides(&types.Release{Name: "app"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no encryption key")
+}
+
+func TestWipeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("password: hunter2\n"), 0o600))
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, wipeFile(path, before.Size()))
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after), "the file is overwritten in place")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, len("password: hunter2\n")), data)
+}
+
+func TestLayeredValueFiles(t *testing.T) {
+	valuesDir := t.TempDir()
+	for _, name := range []string{"default", "prod", "us-east", "cluster1"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(valuesDir, "app"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(valuesDir, "app", name+".yaml"), []byte("{}"), 0o644))
+	}
+	releaseValues := filepath.Join(valuesDir, "release.yaml")
+	require.NoError(t, os.WriteFile(releaseValues, []byte("{}"), 0o644))
+
+	p := &Plugin{
+		ClusterConfig: types.ClusterConfig{
+			Name:      "cluster1",
+			Groups:    []string{"prod", "staging", "us-east"},
+			ValuesDir: valuesDir,
+		},
+	}
+	release := &types.Release{Name: "app", ValueFiles: []string{releaseValues}}
+	assert.Equal(t, []string{
+		filepath.Join(valuesDir, "app", "default.yaml"),
+		releaseValues,
+		filepath.Join(valuesDir, "app", "prod.yaml"),
+		filepath.Join(valuesDir, "app", "us-east.yaml"),
+		filepath.Join(valuesDir, "app", "cluster1.yaml"),
+	}, p.layeredValueFiles(release))
+
+	p.ClusterConfig.ValuesLayers = []string{"cluster", "groups"}
+	assert.Equal(t, []string{
+		filepath.Join(valuesDir, "app", "cluster1.yaml"),
+		filepath.Join(valuesDir, "app", "prod.yaml"),
+		filepath.Join(valuesDir, "app", "us-east.yaml"),
+	}, p.layeredValueFiles(release))
+}
+
+func TestUpgrade(t *testing.T) {
+	disabled := false
+	assert.True(t, (&Plugin{}).upgrade())
+	p := &Plugin{ClusterConfig: types.ClusterConfig{Helm: types.HelmConfig{Upgrade: &disabled}}}
+	assert.False(t, p.upgrade())
+}
+
+func TestUpgradeFalseWithKubectl(t *testing.T) {
+	disabled := false
+	calls := fakeKubectl(t, map[string]string{})
+	p := &Plugin{ClusterConfig: types.ClusterConfig{Helm: types.HelmConfig{Upgrade: &disabled}}, logger: log.New(io.Discard, "", 0)}
+	err := p.installAddon(&types.Release{Name: "manifests", ChartPath: "./charts/manifests", DeploymentMethod: "kubectl"})
+	assert.EqualError(t, err, "helm.upgrade false is not supported for releases with deploymentMethod kubectl")
+	assert.NoFileExists(t, calls, "nothing is applied")
+}
+
+func TestImpersonatedUser(t *testing.T) {
+	for account, expected := range map[string]string{
+		"":                                  "",
+		"deployer":                          "system:serviceaccount:apps:deployer",
+		"kube-system/deployer":              "system:serviceaccount:kube-system:deployer",
+		"system:serviceaccount:ops:manager": "system:serviceaccount:ops:manager",
+	} {
+		p := &Plugin{ClusterConfig: types.ClusterConfig{Helm: types.HelmConfig{ServiceAccount: account}}}
+		assert.Equal(t, expected, p.impersonatedUser("apps"), account)
+	}
+
+	p := &Plugin{ClusterConfig: types.ClusterConfig{Helm: types.HelmConfig{ServiceAccount: "deployer"}}}
+	assert.Equal(t, "system:serviceaccount:default:deployer", p.impersonatedUser(""))
+}
+
+func TestImpersonate(t *testing.T) {
+	p := &Plugin{ClusterConfig: types.ClusterConfig{Helm: types.HelmConfig{ServiceAccount: "ops/deployer"}}}
+
+	kubectl := p.command(constants.KubectlBin)
+	p.impersonate(&kubectl, "apps")
+	assert.Equal(t, "kubectl --as system:serviceaccount:ops:deployer", kubectl.SafeString())
+
+	helm := p.command(constants.HelmBin)
+	p.impersonate(&helm, "apps")
+	assert.Equal(t, "helm", helm.SafeString())
+	assert.Equal(t, []string{"HELM_KUBEASUSER=system:serviceaccount:ops:deployer"}, helm.Env)
+	assert.Empty(t, p.env)
+
+	p = &Plugin{}
+	kubectl = p.command(constants.KubectlBin)
+	p.impersonate(&kubectl, "apps")
+	assert.Equal(t, "kubectl", kubectl.SafeString())
+}
+
 func TestPlugin_ExecReport(t *testing.T) {
 	p := Plugin{
 		ClusterConfigPath: "./test-clusters",
@@ -131,9 +376,9 @@ func TestApplyKubectlFilesSkipsOnDiffrun(t *testing.T) {
 func TestWaitForResourcesSkipsOnDryrun(t *testing.T) {
 	p := &Plugin{Dryrun: true}
 	release := &types.Release{
-		WaitforDeployment:  []string{"sample-deploy"},
-		WaitforDaemonSet:   []string{"sample-daemon"},
-		WaitforStatefulSet: []string{"sample-stateful"},
+		WaitforDeployment:  []types.WaitEntry{{Name: "sample-deploy"}},
+		WaitforDaemonSet:   []types.WaitEntry{{Name: "sample-daemon"}},
+		WaitforStatefulSet: []types.WaitEntry{{Name: "sample-stateful"}},
 	}
 
 	err := p.waitForResources(release)
@@ -143,9 +388,9 @@ func TestWaitForResourcesSkipsOnDryrun(t *testing.T) {
 func TestWaitForResourcesSkipsOnDiffrun(t *testing.T) {
 	p := &Plugin{Diffrun: true}
 	release := &types.Release{
-		WaitforDeployment:  []string{"sample-deploy"},
-		WaitforDaemonSet:   []string{"sample-daemon"},
-		WaitforStatefulSet: []string{"sample-stateful"},
+		WaitforDeployment:  []types.WaitEntry{{Name: "sample-deploy"}},
+		WaitforDaemonSet:   []types.WaitEntry{{Name: "sample-daemon"}},
+		WaitforStatefulSet: []types.WaitEntry{{Name: "sample-stateful"}},
 	}
 
 	err := p.waitForResources(release)
@@ -202,6 +447,29 @@ func TestApplySecretsRequiresEnvironmentVariables(t *testing.T) {
 	assert.Contains(t, err.Error(), "requires environment variable")
 }
 
+func TestApplySecretsDataFromErrors(t *testing.T) {
+	t.Setenv("PASSWORD_ENV", "hunter2")
+	p := &Plugin{}
+	release := &types.Release{
+		Name: "test-release",
+		Secrets: []types.Secret{{
+			Name:     "my-secret",
+			Data:     map[string]string{"password": "PASSWORD_ENV"},
+			DataFrom: map[string]types.ValueFrom{"password": {Environment: "PASSWORD_ENV"}},
+		}},
+	}
+
+	err := p.applySecrets(release)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is set in both data and dataFrom")
+
+	release.Secrets[0].Data = nil
+	release.Secrets[0].DataFrom = map[string]types.ValueFrom{"token": {Dotenv: &types.DotenvSource{File: "does-not-exist.env", Key: "TOKEN"}}}
+	err = p.applySecrets(release)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `secret "my-secret" key "token"`)
+}
+
 func TestApplySecretsRejectsValueWithoutENVSuffix(t *testing.T) {
 	p := &Plugin{}
 	release := &types.Release{
@@ -240,3 +508,435 @@ func TestIsBase64Encoded(t *testing.T) {
 	assert.False(t, isBase64Encoded("hello"))
 	assert.False(t, isBase64Encoded(""))
 }
+
+func TestSecretManifest(t *testing.T) {
+	t.Setenv("API_TOKEN_ENV", "token")
+	t.Setenv("REGISTRY_PASSWORD", "s3cret")
+	dir := t.TempDir()
+	keystore := filepath.Join(dir, "keystore.p12")
+	require.NoError(t, os.WriteFile(keystore, []byte{0x30, 0x82, 0xff, 0x00}, 0o600))
+	release := &types.Release{Name: "my-app", Namespace: "apps"}
+
+	manifest, err := secretManifest(release, types.Secret{
+		Name:        "my-app",
+		Labels:      map[string]string{"team": "a"},
+		Annotations: map[string]string{"owner": "team-a"},
+		Immutable:   true,
+		Data:        map[string]string{"token": "API_TOKEN_ENV"},
+		DataFrom:    map[string]types.ValueFrom{"keystore.p12": {File: keystore}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      "my-app",
+			"namespace": "apps",
+			"labels":    map[string]string{"team": "a"},
+			"annotations": map[string]string{
+				"owner":                            "team-a",
+				"impeller.target.com/content-hash": secretHash("Opaque", map[string]string{"keystore.p12": "MIL/AA=="}, map[string]string{"token": "token"}),
+			},
+		},
+		"type":       "Opaque",
+		"immutable":  true,
+		"data":       map[string]string{"keystore.p12": "MIL/AA=="},
+		"stringData": map[string]string{"token": "token"},
+	}, manifest)
+
+	username := "robot"
+	manifest, err = secretManifest(release, types.Secret{
+		Name:      "registry",
+		Namespace: "build",
+		DockerRegistry: &types.DockerRegistry{
+			Server:   "ghcr.io",
+			Username: &types.Value{Value: &username},
+			Password: &types.Value{ValueFrom: &types.ValueFrom{Environment: "REGISTRY_PASSWORD"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "kubernetes.io/dockerconfigjson", manifest["type"])
+	assert.Equal(t, "build", manifest["metadata"].(map[string]interface{})["namespace"])
+	config, err := base64.StdEncoding.DecodeString(manifest["data"].(map[string]string)[".dockerconfigjson"])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths":{"ghcr.io":{"username":"robot","password":"s3cret","auth":"cm9ib3Q6czNjcmV0"}}}`, string(config))
+
+	_, err = secretManifest(release, types.Secret{
+		Name:     "tls",
+		Type:     "kubernetes.io/tls",
+		DataFrom: map[string]types.ValueFrom{"tls.crt": {File: keystore}},
+	})
+	assert.EqualError(t, err, `secret "tls": type kubernetes.io/tls requires key "tls.key"`)
+}
+
+func TestConfigMapManifest(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "debug")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.properties"), []byte("color=blue\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logo.bin"), []byte{0xff, 0xfe, 0x00}, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0o755))
+	release := &types.Release{Name: "my-app", Namespace: "apps"}
+
+	manifest, err := configMapManifest(release, types.ConfigMap{
+		Name:        "my-app",
+		Labels:      map[string]string{"team": "a"},
+		Data:        map[string]string{"mode": "production"},
+		DataFrom:    map[string]types.ValueFrom{"log-level": {Environment: "LOG_LEVEL"}},
+		Directories: []string{dir},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      "my-app",
+			"namespace": "apps",
+			"labels":    map[string]string{"team": "a"},
+		},
+		"data": map[string]string{
+			"mode":           "production",
+			"log-level":      "debug",
+			"app.properties": "color=blue\n",
+		},
+		"binaryData": map[string]string{"logo.bin": "//4A"},
+	}, manifest)
+
+	_, err = configMapManifest(release, types.ConfigMap{
+		Name:        "my-app",
+		Data:        map[string]string{"app.properties": "color=red"},
+		Directories: []string{dir},
+	})
+	assert.EqualError(t, err, `configmap "my-app": key "app.properties" is set more than once`)
+
+	_, err = configMapManifest(release, types.ConfigMap{Name: "my-app", Data: map[string]string{"a/b": "c"}})
+	assert.EqualError(t, err, `configmap "my-app": invalid key "a/b"`)
+}
+
+func TestApplyConfigMapsPrintsOnDryrun(t *testing.T) {
+	var out bytes.Buffer
+	p := &Plugin{Dryrun: true, logger: log.New(&out, "", 0)}
+	release := &types.Release{
+		Name:       "my-app",
+		Namespace:  "apps",
+		ConfigMaps: []types.ConfigMap{{Name: "settings", Data: map[string]string{"mode": "production"}}},
+	}
+
+	require.NoError(t, p.applyConfigMaps(release))
+	assert.Contains(t, out.String(), "ConfigMap settings:")
+	assert.Contains(t, out.String(), "mode: production")
+}
+
+func TestSecretHash(t *testing.T) {
+	hash := secretHash("Opaque", map[string]string{"password": "aHVudGVyMg=="}, map[string]string{"user": "app"})
+	assert.Len(t, hash, 64)
+	assert.Equal(t, hash, secretHash("Opaque", nil, map[string]string{"password": "hunter2", "user": "app"}), "data and stringData hash the same")
+	assert.NotEqual(t, hash, secretHash("Opaque", nil, map[string]string{"password": "hunter3", "user": "app"}))
+	assert.NotEqual(t, hash, secretHash("kubernetes.io/basic-auth", nil, map[string]string{"password": "hunter2", "user": "app"}))
+	assert.NotEqual(t, secretHash("Opaque", nil, map[string]string{"a": "b\x00c"}), secretHash("Opaque", nil, map[string]string{"a": "b", "c": ""}))
+}
+
+// fakeKubectl puts a kubectl script on the PATH which logs its arguments
+// and prints the output given for the first two arguments, e.g. "get job".
+func fakeKubectl(t *testing.T, outputs map[string]string) string {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\ncat > /dev/null\ncase \"$1 $2\" in\n"
+	for args, output := range outputs {
+		script += fmt.Sprintf("%q) printf '%%s' '%s' ;;\n", args, output)
+	}
+	script += "esac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func TestApplySecretsRestartOnChange(t *testing.T) {
+	t.Setenv("PASSWORD_ENV", "hunter2")
+	release := &types.Release{
+		Name:      "my-app",
+		Namespace: "apps",
+		Secrets: []types.Secret{{
+			Name:            "my-app",
+			Data:            map[string]string{"password": "PASSWORD_ENV"},
+			RestartOnChange: []string{"deployment/my-app"},
+		}},
+	}
+	hash := secretHash("Opaque", nil, map[string]string{"password": "hunter2"})
+
+	for _, tc := range []struct {
+		name       string
+		liveSecret string
+		restarted  bool
+	}{
+		{"new secret", "", false},
+		{"unchanged", "my-app " + hash, false},
+		{"changed", "my-app 0123", true},
+		{"no hash annotation", "my-app ", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := fakeKubectl(t, map[string]string{"get secret": tc.liveSecret, "get deployment": `{"metadata":{"generation":2},"status":{"observedGeneration":2,"replicas":1,"updatedReplicas":1,"availableReplicas":1}}`})
+			p := &Plugin{KubeContext: "lab", logger: log.New(io.Discard, "", 0)}
+			require.NoError(t, p.applySecrets(release))
+
+			out, err := os.ReadFile(calls)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			assert.Equal(t, "get secret my-app --ignore-not-found --namespace apps --context lab --output jsonpath={.metadata.name} {.metadata.annotations.impeller\\.target\\.com/content-hash}", lines[0])
+			assert.Equal(t, "apply --filename - --context lab", lines[1])
+			if tc.restarted {
+				require.Len(t, lines, 4)
+				assert.Equal(t, "rollout restart deployment/my-app --namespace apps --context lab", lines[2])
+				assert.Equal(t, "get deployment my-app --ignore-not-found --namespace apps --context lab --output json", lines[3])
+			} else {
+				assert.Len(t, lines, 2)
+			}
+		})
+	}
+}
+
+func TestApplySecretsWithoutRestartOnChange(t *testing.T) {
+	t.Setenv("PASSWORD_ENV", "hunter2")
+	release := &types.Release{
+		Name:      "my-app",
+		Namespace: "apps",
+		Secrets: []types.Secret{{
+			Name: "my-app",
+			Data: map[string]string{"password": "PASSWORD_ENV"},
+		}},
+	}
+	calls := fakeKubectl(t, map[string]string{})
+	p := &Plugin{KubeContext: "lab", logger: log.New(io.Discard, "", 0)}
+	require.NoError(t, p.applySecrets(release))
+
+	out, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "apply --filename - --context lab\n", string(out))
+}
+
+func TestSetupKubeconfigInvalidBase64(t *testing.T) {
+	p := &Plugin{KubeConfig: "not base64!", KubeConfigBase64: true, stateDir: t.TempDir(), logger: log.New(io.Discard, "", 0)}
+	err := p.setupKubeconfig()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error decoding kube config: illegal base64 data")
+	assert.NoFileExists(t, filepath.Join(p.stateDir, "kubeconfig"))
+}
+
+func TestWaitFor(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "my-app", Namespace: "apps"}
+
+	calls := fakeKubectl(t, map[string]string{"get job": `{"status":{"conditions":[{"type":"Complete","status":"True"}]}}`})
+	require.NoError(t, p.waitForResource(release, types.WaitFor{Kind: "job", Name: "migrate"}))
+	out, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "get job migrate --ignore-not-found --namespace apps --output json\n", string(out))
+
+	fakeKubectl(t, map[string]string{"get job": `{"status":{"conditions":[{"type":"Failed","status":"True","reason":"BackoffLimitExceeded"}]}}`})
+	assert.EqualError(t, p.waitForResource(release, types.WaitFor{Kind: "job", Name: "migrate"}), "job failed: BackoffLimitExceeded")
+
+	fakeKubectl(t, map[string]string{"get certificates.cert-manager.io": `{"status":{"conditions":[{"type":"Issuing","status":"True"}]}}`})
+	require.NoError(t, p.waitForResource(release, types.WaitFor{Kind: "certificates.cert-manager.io", Name: "web-tls", Namespace: "web", Condition: "Issuing"}))
+}
+
+func TestWaitForTimeout(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "my-app", Namespace: "apps", WaitTimeout: "1h", PollInterval: "1h"}
+	calls := fakeKubectl(t, map[string]string{"get job": `{"status":{"active":1}}`})
+
+	start := time.Now()
+	err := p.waitForResource(release, types.WaitFor{Kind: "job", Name: "migrate", Timeout: "300ms", PollInterval: "50ms"})
+	require.Error(t, err)
+	assert.Regexp(t, `^timeout waiting for job apps/migrate after \d+s: 1 active, 0 succeeded$`, err.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	out, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Greater(t, strings.Count(string(out), "\n"), 1, "the job is polled more than once")
+}
+
+func TestWaitForResourcesEntryTimeout(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{
+		Name:               "elasticsearch",
+		Namespace:          "search",
+		WaitTimeout:        "1h",
+		WaitforStatefulSet: []types.WaitEntry{{Name: "elasticsearch-master", Timeout: "200ms", PollInterval: "50ms"}},
+	}
+	fakeKubectl(t, map[string]string{})
+
+	start := time.Now()
+	err := p.waitForResources(release)
+	require.Error(t, err)
+	assert.Regexp(t, `^error waiting for statefulset "elasticsearch-master": timeout waiting for statefulset search/elasticsearch-master after \d+s: not found$`, err.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWaitForKubectlError(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "my-app", Namespace: "apps", WaitTimeout: "1h"}
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho 'error: the server doesn'\\''t have a resource type \"jbo\"' >&2\nexit 1\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	start := time.Now()
+	err := p.waitForResource(release, types.WaitFor{Kind: "jbo", Name: "migrate"})
+	assert.EqualError(t, err, `error running kubectl get jbo migrate --ignore-not-found: error: the server doesn't have a resource type "jbo"`)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWaitForNotFound(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "my-app", Namespace: "apps"}
+	fakeKubectl(t, map[string]string{})
+
+	err := p.waitForResource(release, types.WaitFor{Kind: "job", Name: "migrate", Timeout: "200ms", PollInterval: "50ms"})
+	require.Error(t, err)
+	assert.Regexp(t, `^timeout waiting for job apps/migrate after \d+s: not found$`, err.Error())
+}
+
+func TestWaitOptions(t *testing.T) {
+	p := &Plugin{}
+	release := &types.Release{}
+
+	timeout, pollInterval, err := p.waitOptions(release, types.WaitFor{Kind: "deployment"})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, timeout)
+	assert.Equal(t, 10*time.Second, pollInterval)
+
+	timeout, _, err = p.waitOptions(release, types.WaitFor{Kind: "sts"})
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, timeout)
+
+	p.ClusterConfig.Helm = types.HelmConfig{WaitTimeout: "10m", PollInterval: "5s"}
+	timeout, pollInterval, err = p.waitOptions(release, types.WaitFor{Kind: "deployment"})
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, timeout)
+	assert.Equal(t, 5*time.Second, pollInterval)
+
+	// --wait-timeout overrides the cluster-wide timeout.
+	p.WaitTimeout = 15 * time.Minute
+	timeout, _, err = p.waitOptions(release, types.WaitFor{Kind: "sts"})
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, timeout)
+
+	release.WaitTimeout, release.PollInterval = "30m", "20s"
+	timeout, pollInterval, err = p.waitOptions(release, types.WaitFor{Kind: "deployment"})
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, timeout)
+	assert.Equal(t, 20*time.Second, pollInterval)
+
+	timeout, pollInterval, err = p.waitOptions(release, types.WaitFor{Kind: "deployment", Timeout: "90s", PollInterval: "1s"})
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+	assert.Equal(t, time.Second, pollInterval)
+
+	_, _, err = p.waitOptions(release, types.WaitFor{Kind: "deployment", Timeout: "forever"})
+	assert.EqualError(t, err, `wait timeout: invalid duration "forever", must be positive, e.g. 90s or 10m`)
+}
+
+func TestInstallAddonViaKubectlRendersInReleaseNamespace(t *testing.T) {
+	kubectlCalls := fakeKubectl(t, map[string]string{})
+	dir := t.TempDir()
+	helmCalls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + helmCalls + "\nprintf 'kind: ConfigMap\\n'\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "helm"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p := &Plugin{KubeContext: "lab", logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "my-app", Namespace: "apps", ChartPath: "stable/my-app", Version: "1.0.0", DeploymentMethod: "kubectl"}
+	require.NoError(t, p.installAddonViaKubectl(release))
+
+	out, err := os.ReadFile(helmCalls)
+	require.NoError(t, err)
+	assert.Equal(t, "template my-app stable/my-app --version 1.0.0 --namespace apps\n", string(out))
+	out, err = os.ReadFile(kubectlCalls)
+	require.NoError(t, err)
+	assert.Equal(t, "--namespace apps --context lab apply --filename -\n", string(out))
+}
+
+func TestDiscoverWorkloads(t *testing.T) {
+	manifests := `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+  namespace: jobs
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+  namespace: kube-system
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: smoke-test
+  annotations:
+    helm.sh/hook: test
+---
+`
+	release := &types.Release{
+		Name:              "app",
+		Namespace:         "apps",
+		WaitforDeployment: []types.WaitEntry{{Name: "web"}},
+		WaitFor:           []types.WaitFor{{Kind: "sts", Name: "db", Namespace: "apps"}},
+	}
+
+	workloads, err := discoverWorkloads(release, manifests)
+	require.NoError(t, err)
+	assert.Equal(t, []types.WaitFor{
+		{Kind: "deployment", Name: "worker", Namespace: "jobs"},
+		{Kind: "daemonset", Name: "agent", Namespace: "kube-system"},
+		{Kind: "job", Name: "migrate"},
+	}, workloads)
+
+	release.DeploymentMethod = "kubectl"
+	workloads, err = discoverWorkloads(release, manifests)
+	require.NoError(t, err)
+	assert.Contains(t, workloads, types.WaitFor{Kind: "job", Name: "smoke-test"})
+
+	_, err = discoverWorkloads(release, "kind: [")
+	assert.Error(t, err)
+}
+
+func TestWaitForFailsOnBrokenPods(t *testing.T) {
+	p := &Plugin{logger: log.New(io.Discard, "", 0)}
+	release := &types.Release{Name: "web", Namespace: "apps"}
+	calls := fakeKubectl(t, map[string]string{
+		"get deployment":  `{"metadata":{"generation":2,"annotations":{"deployment.kubernetes.io/revision":"2"}},"spec":{"replicas":1,"selector":{"matchLabels":{"app":"web"}}},"status":{"observedGeneration":2,"replicas":2,"updatedReplicas":1,"availableReplicas":1}}`,
+		"get replicasets": `{"items":[{"metadata":{"annotations":{"deployment.kubernetes.io/revision":"2"},"labels":{"pod-template-hash":"bbb"}}}]}`,
+		"get pods":        `{"items":[{"metadata":{"name":"web-aaa-1","labels":{"pod-template-hash":"aaa"}},"status":{"containerStatuses":[{"name":"app","restartCount":9,"state":{"waiting":{"reason":"CrashLoopBackOff"}}}]}},{"metadata":{"name":"web-bbb-1","labels":{"pod-template-hash":"bbb"}},"status":{"containerStatuses":[{"name":"app","state":{"waiting":{"reason":"ImagePullBackOff","message":"Back-off pulling image"}}}]}}]}`,
+	})
+
+	start := time.Now()
+	err := p.waitForResources(&types.Release{Name: release.Name, Namespace: release.Namespace, WaitforDeployment: []types.WaitEntry{{Name: "web"}}})
+	assert.EqualError(t, err, `error waiting for deployment "web": pod web-bbb-1 container app: ImagePullBackOff: Back-off pulling image`)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	out, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "get pods --selector app=web --namespace apps --output json")
+}
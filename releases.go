@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/target/impeller/types"
+	"github.com/target/impeller/utils/condition"
+	"github.com/target/impeller/utils/graph"
+	"github.com/target/impeller/utils/selector"
+)
+
+const (
+	releasePending = iota
+	releaseRunning
+	releaseSucceeded
+	releaseFailed
+	releaseNotSelected
+)
+
+type releaseResult struct {
+	node int
+	err  error
+}
+
+// releaseGraph builds the dependency graph of the releases from their
+// `dependsOn` fields. Node indexes match the indexes in releases.
+func releaseGraph(releases []types.Release) (*graph.Graph, error) {
+	g := graph.New()
+	byName := map[string][]int{}
+	for i, release := range releases {
+		g.AddNode(release.Name)
+		byName[release.Name] = append(byName[release.Name], i)
+	}
+
+	for i, release := range releases {
+		for _, dependency := range release.DependsOn {
+			nodes, ok := byName[dependency]
+			if !ok {
+				return nil, fmt.Errorf("release \"%s\" depends on unknown release \"%s\"", release.Name, dependency)
+			}
+			for _, node := range nodes {
+				g.AddDependency(i, node)
+			}
+		}
+	}
+
+	if _, err := g.Sort(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// parallelism returns the maximum number of releases to install at once.
+// The --parallelism flag takes precedence over `helm.parallelism`.
+func (p *Plugin) parallelism() int {
+	if p.Parallelism > 0 {
+		return p.Parallelism
+	}
+	if p.ClusterConfig.Helm.Parallelism > 0 {
+		return p.ClusterConfig.Helm.Parallelism
+	}
+	return 1
+}
+
+// selectReleases reports which releases of a cluster config are selected by
+// the --release and --selector flags and are enabled, see releaseEnabled.
+// Every release which is not selected is logged with the reason.
+func (p *Plugin) selectReleases(config types.ClusterConfig) ([]bool, error) {
+	selected, err := p.selectReleasesByFlags(config.Releases)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, release := range config.Releases {
+		if !selected[i] {
+			continue
+		}
+		enabled, reason, err := releaseEnabled(config, release)
+		if err != nil {
+			return nil, fmt.Errorf("release \"%s\": %v", release.Name, err)
+		}
+		if !enabled {
+			p.log().Printf("Skipping addon \"%s\": %s", release.Name, reason)
+			selected[i] = false
+		}
+	}
+	return selected, nil
+}
+
+// selectReleasesByFlags reports which releases are selected by the
+// --release and --selector flags and logs every release which is not, and
+// why.
+func (p *Plugin) selectReleasesByFlags(releases []types.Release) ([]bool, error) {
+	sel, err := selector.Parse(p.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, name := range p.ReleaseNames {
+		names[name] = false
+	}
+
+	selected := make([]bool, len(releases))
+	for i, release := range releases {
+		if len(p.ReleaseNames) > 0 {
+			if _, ok := names[release.Name]; !ok {
+				p.log().Printf("Skipping addon \"%s\": not selected with --release", release.Name)
+				continue
+			}
+			names[release.Name] = true
+		}
+		if !sel.Matches(release.Labels) {
+			p.log().Printf("Skipping addon \"%s\": labels do not match selector \"%s\"", release.Name, sel)
+			continue
+		}
+		selected[i] = true
+	}
+
+	for _, name := range p.ReleaseNames {
+		if !names[name] {
+			p.log().Printf("WARNING: release \"%s\" selected with --release does not exist", name)
+		}
+	}
+	return selected, nil
+}
+
+// releaseEnabled evaluates the `enabled` flag and the `when` condition of a
+// release against the cluster name and variables. If the release is
+// disabled, the reason is returned.
+func releaseEnabled(config types.ClusterConfig, release types.Release) (bool, string, error) {
+	if release.Enabled != nil && !*release.Enabled {
+		return false, "disabled", nil
+	}
+	if release.When == "" {
+		return true, "", nil
+	}
+	enabled, err := condition.Evaluate(release.When, config.ConditionVars())
+	if err != nil {
+		return false, "", err
+	}
+	if !enabled {
+		return false, fmt.Sprintf("condition %s is false", release.When), nil
+	}
+	return true, "", nil
+}
+
+// installReleases installs the selected releases in dependency order,
+// running up to parallelism() releases at once. A release is started once
+// all of its dependencies are installed; dependencies which are not selected
+// are assumed to be installed already. When a release fails, every release
+// depending on it is skipped; releases which do not depend on it are still
+// installed. All failures and skipped releases are reported in the returned
+// error. A nil selected installs all releases.
+func (p *Plugin) installReleases(g *graph.Graph, selected []bool) error {
+	order, err := g.Sort()
+	if err != nil {
+		return err
+	}
+
+	parallelism := p.parallelism()
+	if parallelism > 1 {
+		p.log().Printf("Installing releases with parallelism %d", parallelism)
+	}
+
+	state := make([]int, g.Len())
+	errs := make([]string, g.Len())
+	results := make(chan releaseResult)
+	running, finished := 0, 0
+	for i := range selected {
+		if !selected[i] {
+			state[i] = releaseNotSelected
+			finished++
+		}
+	}
+
+	for finished < g.Len() {
+		for _, i := range order {
+			if running >= parallelism {
+				break
+			}
+			if state[i] != releasePending {
+				continue
+			}
+			release := &p.ClusterConfig.Releases[i]
+			if dependency, ok := dependencyInState(g, i, state, releaseFailed); ok {
+				p.log().Printf("Skipping addon \"%s\": dependency \"%s\" was not installed", release.Name, g.Name(dependency))
+				state[i] = releaseFailed
+				errs[i] = fmt.Sprintf("addon \"%s\" skipped: dependency \"%s\" was not installed", release.Name, g.Name(dependency))
+				finished++
+				continue
+			}
+			if _, ok := dependencyInState(g, i, state, releasePending, releaseRunning); ok {
+				continue
+			}
+
+			state[i] = releaseRunning
+			running++
+			rp := p
+			if parallelism > 1 {
+				rp = p.withLogPrefix(fmt.Sprintf("[%s] ", release.Name))
+			}
+			go func(node int, release *types.Release) {
+				results <- releaseResult{node: node, err: rp.installAddonFlushed(release)}
+			}(i, release)
+		}
+
+		if running == 0 {
+			continue
+		}
+		result := <-results
+		running--
+		finished++
+		if result.err != nil {
+			name := p.ClusterConfig.Releases[result.node].Name
+			p.log().Printf("ERROR: installing addon \"%s\" failed: %v", name, result.err)
+			state[result.node] = releaseFailed
+			errs[result.node] = fmt.Sprintf("error installing addon \"%s\": %v", name, result.err)
+		} else {
+			state[result.node] = releaseSucceeded
+		}
+	}
+
+	var summary []string
+	for _, i := range order {
+		if errs[i] != "" {
+			summary = append(summary, errs[i])
+		}
+	}
+	if len(summary) > 0 {
+		p.log().Printf("%d of %d releases were not installed:", len(summary), g.Len())
+		for _, line := range summary {
+			p.log().Printf("  %s", line)
+		}
+		return fmt.Errorf("%s", strings.Join(summary, "; "))
+	}
+	return nil
+}
+
+// installAddonFlushed installs a release and flushes any partial output
+// line left in the release's prefixed writers.
+func (p *Plugin) installAddonFlushed(release *types.Release) error {
+	err := p.installAddon(release)
+	p.flushOutput()
+	return err
+}
+
+// dependencyInState returns the first dependency of node in one of the
+// given states.
+func dependencyInState(g *graph.Graph, node int, state []int, states ...int) (int, bool) {
+	for _, dependency := range g.Dependencies(node) {
+		for _, s := range states {
+			if state[dependency] == s {
+				return dependency, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// catalogDivergence returns the fields, out of those a cluster config may
+// change, in which a release differs from its catalog definition.
+func catalogDivergence(release, catalog types.Release) (fields []string) {
+	if release.Version != catalog.Version {
+		fields = append(fields, "version")
+	}
+	if release.Namespace != catalog.Namespace {
+		fields = append(fields, "namespace")
+	}
+	if !reflect.DeepEqual(release.Overrides, catalog.Overrides) {
+		fields = append(fields, "overrides")
+	}
+	if !reflect.DeepEqual(release.Values, catalog.Values) {
+		fields = append(fields, "values")
+	}
+	return fields
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/target/impeller/types"
+)
+
+func TestReleaseGraphOrder(t *testing.T) {
+	releases := []types.Release{
+		{Name: "apps", DependsOn: []string{"ingress"}},
+		{Name: "ingress", DependsOn: []string{"cert-manager"}},
+		{Name: "cert-manager"},
+		{Name: "monitoring"},
+	}
+
+	g, err := releaseGraph(releases)
+	require.NoError(t, err)
+	order, err := g.Sort()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 1, 0, 3}, order)
+}
+
+func TestReleaseGraphUnknownDependency(t *testing.T) {
+	releases := []types.Release{
+		{Name: "apps", DependsOn: []string{"ingress"}},
+	}
+
+	_, err := releaseGraph(releases)
+	require.Error(t, err)
+	assert.Equal(t, "release \"apps\" depends on unknown release \"ingress\"", err.Error())
+}
+
+func TestReleaseGraphCycle(t *testing.T) {
+	releases := []types.Release{
+		{Name: "apps", DependsOn: []string{"ingress"}},
+		{Name: "ingress", DependsOn: []string{"apps"}},
+	}
+
+	_, err := releaseGraph(releases)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "apps -> ingress -> apps")
+}
+
+func TestInstallReleasesSkipsDependents(t *testing.T) {
+	p := &Plugin{
+		ClusterConfig: types.ClusterConfig{
+			Releases: []types.Release{
+				{Name: "broken", DeploymentMethod: "kubectl", ChartPath: "does-not-exist/chart"},
+				{Name: "dependent", DependsOn: []string{"broken"}},
+			},
+		},
+	}
+
+	g, err := releaseGraph(p.ClusterConfig.Releases)
+	require.NoError(t, err)
+	err = p.installReleases(g, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error installing addon \"broken\"")
+	assert.Contains(t, err.Error(), "addon \"dependent\" skipped: dependency \"broken\" was not installed")
+}
+
+func TestParallelism(t *testing.T) {
+	p := &Plugin{}
+	assert.Equal(t, 1, p.parallelism())
+
+	p.ClusterConfig.Helm.Parallelism = 4
+	assert.Equal(t, 4, p.parallelism())
+
+	p.Parallelism = 2
+	assert.Equal(t, 2, p.parallelism())
+}
+
+func TestInstallReleasesParallelSkipsDependents(t *testing.T) {
+	p := &Plugin{
+		Parallelism: 3,
+		ClusterConfig: types.ClusterConfig{
+			Releases: []types.Release{
+				{Name: "broken-1", DeploymentMethod: "kubectl", ChartPath: "does-not-exist/chart"},
+				{Name: "broken-2", DeploymentMethod: "kubectl", ChartPath: "does-not-exist/chart"},
+				{Name: "dependent", DependsOn: []string{"broken-1", "broken-2"}},
+				{Name: "transitive", DependsOn: []string{"dependent"}},
+			},
+		},
+	}
+
+	g, err := releaseGraph(p.ClusterConfig.Releases)
+	require.NoError(t, err)
+	err = p.installReleases(g, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error installing addon \"broken-1\"")
+	assert.Contains(t, err.Error(), "error installing addon \"broken-2\"")
+	assert.Contains(t, err.Error(), "addon \"dependent\" skipped")
+	assert.Contains(t, err.Error(), "addon \"transitive\" skipped: dependency \"dependent\" was not installed")
+}
+
+func TestSelectReleases(t *testing.T) {
+	releases := []types.Release{
+		{Name: "cert-manager", Labels: map[string]string{"tier": "infra", "team": "platform"}},
+		{Name: "ingress", Labels: map[string]string{"tier": "infra", "team": "data"}},
+		{Name: "apps", Labels: map[string]string{"tier": "apps"}},
+		{Name: "monitoring"},
+	}
+
+	selected, err := (&Plugin{}).selectReleasesByFlags(releases)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true, true}, selected)
+
+	selected, err = (&Plugin{Selector: "tier=infra,team!=data"}).selectReleasesByFlags(releases)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, false, false}, selected)
+
+	selected, err = (&Plugin{ReleaseNames: []string{"apps", "monitoring", "does-not-exist"}}).selectReleasesByFlags(releases)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, true}, selected)
+
+	selected, err = (&Plugin{ReleaseNames: []string{"apps", "ingress"}, Selector: "tier=infra"}).selectReleasesByFlags(releases)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false, false}, selected)
+
+	_, err = (&Plugin{Selector: "=infra"}).selectReleasesByFlags(releases)
+	require.Error(t, err)
+}
+
+func TestSelectReleasesConditions(t *testing.T) {
+	disabled := false
+	config := types.ClusterConfig{
+		Name: "east-1",
+		Vars: map[string]string{"region": "us-east"},
+		Releases: []types.Release{
+			{Name: "always"},
+			{Name: "disabled", Enabled: &disabled},
+			{Name: "east", When: `cluster.vars.region == "us-east"`},
+			{Name: "west", When: `cluster.vars.region == "us-west"`},
+			{Name: "not-lab", When: `cluster.name != "lab" && !(cluster.vars.region == "eu")`},
+		},
+	}
+
+	selected, err := (&Plugin{}).selectReleases(config)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true, false, true}, selected)
+
+	selected, err = (&Plugin{ReleaseNames: []string{"disabled", "east"}}).selectReleases(config)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, true, false, false}, selected)
+
+	config.Releases = append(config.Releases, types.Release{Name: "undefined", When: `cluster.vars.zone == "a"`})
+	_, err = (&Plugin{}).selectReleases(config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `release "undefined": invalid condition`)
+}
+
+func TestReleaseEnabled(t *testing.T) {
+	disabled := false
+	config := types.ClusterConfig{Name: "lab"}
+
+	enabled, reason, err := releaseEnabled(config, types.Release{Enabled: &disabled, When: `cluster.name == "lab"`})
+	require.NoError(t, err)
+	assert.False(t, enabled)
+	assert.Equal(t, "disabled", reason)
+
+	enabled, reason, err = releaseEnabled(config, types.Release{When: `cluster.name != "lab"`})
+	require.NoError(t, err)
+	assert.False(t, enabled)
+	assert.Equal(t, `condition cluster.name != "lab" is false`, reason)
+
+	enabled, _, err = releaseEnabled(config, types.Release{When: `cluster.name == "lab"`})
+	require.NoError(t, err)
+	assert.True(t, enabled)
+}
+
+func TestInstallReleasesSkipsUnselected(t *testing.T) {
+	p := &Plugin{
+		ClusterConfig: types.ClusterConfig{
+			Releases: []types.Release{
+				{Name: "broken", DeploymentMethod: "kubectl", ChartPath: "does-not-exist/chart"},
+				{Name: "dependent", DependsOn: []string{"broken"}},
+			},
+		},
+	}
+
+	g, err := releaseGraph(p.ClusterConfig.Releases)
+	require.NoError(t, err)
+	err = p.installReleases(g, []bool{false, false})
+	require.NoError(t, err)
+}
+
+func TestCatalogDivergence(t *testing.T) {
+	one, three := "1", "3"
+	catalog := types.Release{
+		Name:      "cert-manager",
+		ChartPath: "jetstack/cert-manager",
+		Version:   "1.13.0",
+		Namespace: "cert-manager",
+		Overrides: []types.Override{{Target: "replicaCount", Value: types.Value{Value: &one}}},
+	}
+
+	release := catalog
+	release.Overrides = []types.Override{{Target: "replicaCount", Value: types.Value{Value: &one}}}
+	assert.Empty(t, catalogDivergence(release, catalog))
+
+	release.Version = "1.14.0"
+	release.Overrides = []types.Override{{Target: "replicaCount", Value: types.Value{Value: &three}}}
+	assert.Equal(t, []string{"version", "overrides"}, catalogDivergence(release, catalog))
+}
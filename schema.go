@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/target/impeller/utils"
+
+	"github.com/urfave/cli"
+)
+
+var schemaCommand = cli.Command{
+	Name:   "schema",
+	Usage:  "Print the JSON Schema of cluster config files",
+	Action: runSchema,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "fleet",
+			Usage: "Print the JSON Schema of fleet files instead",
+		},
+	},
+}
+
+func runSchema(ctx *cli.Context) error {
+	generate := utils.ClusterConfigSchema
+	if ctx.Bool("fleet") {
+		generate = utils.FleetConfigSchema
+	}
+
+	schema, err := generate()
+	if err != nil {
+		return fmt.Errorf("Error generating schema: %v", err)
+	}
+	fmt.Println(string(schema))
+	return nil
+}
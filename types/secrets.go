@@ -0,0 +1,221 @@
+package types
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider resolves a value from a secret source, such as an
+// environment variable, a file or a secret store.
+type SecretProvider interface {
+	GetValue() (string, error)
+}
+
+// EnvironmentSource reads a value from an environment variable.
+type EnvironmentSource string
+
+func (s EnvironmentSource) GetValue() (string, error) {
+	return os.Getenv(string(s)), nil
+}
+
+// FileSource reads a value from a file.
+type FileSource string
+
+func (s FileSource) GetValue() (string, error) {
+	bytes, err := ioutil.ReadFile(string(s))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// DotenvSource reads a value from a dotenv file of KEY=value lines.
+type DotenvSource struct {
+	File string `yaml:"file" jsonschema:"required" description:"Path of the dotenv file"`
+	Key  string `yaml:"key" jsonschema:"required" description:"Name of the variable in the dotenv file"`
+}
+
+func (s DotenvSource) GetValue() (string, error) {
+	values, err := readDotenv(s.File)
+	if err != nil {
+		return "", err
+	}
+	value, ok := values[s.Key]
+	if !ok {
+		return "", fmt.Errorf("key \"%s\" not found in dotenv file \"%s\"", s.Key, s.File)
+	}
+	return value, nil
+}
+
+// readDotenv parses a dotenv file. Blank lines and lines starting with # are
+// ignored, an optional `export ` prefix is removed and values may be quoted.
+func readDotenv(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// VaultSource reads a value from a HashiCorp Vault KV version 2 secrets
+// engine. The server and token are taken from the VAULT_ADDR and
+// VAULT_TOKEN environment variables, and VAULT_NAMESPACE if set.
+type VaultSource struct {
+	Path  string `yaml:"path" jsonschema:"required" description:"Path of the secret including the mount, e.g. secret/my-app"`
+	Key   string `yaml:"key" jsonschema:"required" description:"Key of the value in the secret"`
+	Mount string `yaml:"mount,omitempty" description:"Mount path of the KV secrets engine if it contains a slash, in which case path is relative to it"`
+}
+
+// vaultClient is used for all Vault requests. Each secret is only read once
+// per run and token, even if several of its keys are used. The cache is
+// keyed by vaultCacheKey, so clusters using other tokens or namespaces for
+// the same path read the secret themselves. vaultCacheMutex only guards the
+// map; concurrent reads of the same secret wait for the request in flight,
+// while reads of other secrets proceed in parallel.
+var (
+	vaultClient     = &http.Client{Timeout: 30 * time.Second}
+	vaultCache      = map[string]*vaultRead{}
+	vaultCacheMutex sync.Mutex
+)
+
+// vaultRead is a read of a Vault secret, done once done is closed.
+type vaultRead struct {
+	done chan struct{}
+	data map[string]interface{}
+	err  error
+}
+
+func (s VaultSource) GetValue() (string, error) {
+	data, err := s.readSecret()
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[s.Key]
+	if !ok {
+		return "", fmt.Errorf("key \"%s\" not found in vault secret \"%s\"", s.Key, s.Path)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// url returns the KV v2 API URL of the secret, <mount>/data/<path>.
+func (s VaultSource) url(addr string) (string, error) {
+	mount, path := strings.Trim(s.Mount, "/"), strings.Trim(s.Path, "/")
+	if mount == "" {
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", fmt.Errorf("vault path \"%s\" must include the mount, e.g. secret/my-app", s.Path)
+		}
+		mount, path = parts[0], parts[1]
+	}
+	return fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(addr, "/"), mount, path), nil
+}
+
+func (s VaultSource) readSecret() (map[string]interface{}, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	url, err := s.url(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	token, namespace := os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE")
+	key := vaultCacheKey(url, token, namespace)
+
+	vaultCacheMutex.Lock()
+	read, ok := vaultCache[key]
+	if !ok {
+		read = &vaultRead{done: make(chan struct{})}
+		vaultCache[key] = read
+	}
+	vaultCacheMutex.Unlock()
+	if ok {
+		<-read.done
+		return read.data, read.err
+	}
+
+	read.data, read.err = s.fetch(url, token, namespace)
+	if read.err != nil {
+		// Failed reads are not cached, so later reads try again.
+		vaultCacheMutex.Lock()
+		delete(vaultCache, key)
+		vaultCacheMutex.Unlock()
+	}
+	close(read.done)
+	return read.data, read.err
+}
+
+// fetch reads the secret at url from Vault.
+func (s VaultSource) fetch(url, token, namespace string) (map[string]interface{}, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if namespace != "" {
+		request.Header.Set("X-Vault-Namespace", namespace)
+	}
+	response, err := vaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret \"%s\": %v", s.Path, err)
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil && response.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("error decoding vault secret \"%s\": %v", s.Path, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error reading vault secret \"%s\": %s", s.Path, strings.TrimSpace(response.Status+" "+strings.Join(body.Errors, "; ")))
+	}
+	return body.Data.Data, nil
+}
+
+// vaultCacheKey identifies a secret read with a token in a Vault namespace.
+// The token is hashed so the cache does not hold it.
+func vaultCacheKey(url, token, namespace string) string {
+	hash := sha256.Sum256([]byte(token))
+	return url + " " + namespace + " " + hex.EncodeToString(hash[:])
+}
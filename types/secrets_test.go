@@ -0,0 +1,208 @@
+package types
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDotenvSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(file, []byte(`# credentials
+USERNAME=admin
+export PASSWORD="hunter2 with spaces"
+
+TOKEN='a=b'
+`), 0o600))
+
+	for key, expected := range map[string]string{
+		"USERNAME": "admin",
+		"PASSWORD": "hunter2 with spaces",
+		"TOKEN":    "a=b",
+	} {
+		value, err := DotenvSource{File: file, Key: key}.GetValue()
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	_, err := DotenvSource{File: file, Key: "MISSING"}.GetValue()
+	assert.EqualError(t, err, `key "MISSING" not found in dotenv file "`+file+`"`)
+
+	require.NoError(t, os.WriteFile(file, []byte("USERNAME\n"), 0o600))
+	_, err = DotenvSource{File: file, Key: "USERNAME"}.GetValue()
+	assert.EqualError(t, err, file+":1: expected KEY=value")
+}
+
+func TestVaultSource(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/my-app":
+			w.Write([]byte(`{"data":{"data":{"password":"hunter2","ports":[80,443]},"metadata":{"version":3}}}`))
+		case "/v1/kv/team-a/data/db":
+			w.Write([]byte(`{"data":{"data":{"user":"app"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+
+	value, err := VaultSource{Path: "secret/my-app", Key: "password"}.GetValue()
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	value, err = VaultSource{Path: "/secret/my-app/", Key: "ports"}.GetValue()
+	require.NoError(t, err)
+	assert.Equal(t, "[80,443]", value)
+	assert.Equal(t, 1, requests, "secrets are read once")
+
+	value, err = VaultSource{Mount: "kv/team-a", Path: "db", Key: "user"}.GetValue()
+	require.NoError(t, err)
+	assert.Equal(t, "app", value)
+
+	_, err = VaultSource{Path: "secret/my-app", Key: "missing"}.GetValue()
+	assert.EqualError(t, err, `key "missing" not found in vault secret "secret/my-app"`)
+
+	_, err = VaultSource{Path: "secret/other", Key: "password"}.GetValue()
+	assert.EqualError(t, err, `error reading vault secret "secret/other": 404 Not Found`)
+
+	_, err = VaultSource{Path: "my-app", Key: "password"}.GetValue()
+	assert.EqualError(t, err, `vault path "my-app" must include the mount, e.g. secret/my-app`)
+
+	t.Setenv("VAULT_TOKEN", "wrong-token")
+	_, err = VaultSource{Path: "secret/forbidden", Key: "password"}.GetValue()
+	assert.EqualError(t, err, `error reading vault secret "secret/forbidden": 403 Forbidden permission denied`)
+
+	// Secrets cached for another token are read again with this one.
+	_, err = VaultSource{Path: "secret/my-app", Key: "password"}.GetValue()
+	assert.EqualError(t, err, `error reading vault secret "secret/my-app": 403 Forbidden permission denied`)
+}
+
+func TestVaultSourceConcurrentReads(t *testing.T) {
+	var requests int32
+	slow := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/v1/secret/data/slow" {
+			<-slow
+		}
+		w.Write([]byte(`{"data":{"data":{"password":"hunter2"}}}`))
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "concurrent-token")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := VaultSource{Path: "secret/slow", Key: "password"}.GetValue()
+			assert.NoError(t, err)
+			assert.Equal(t, "hunter2", value)
+		}()
+	}
+
+	// Other secrets are read while the slow one is in flight.
+	value, err := VaultSource{Path: "secret/fast", Key: "password"}.GetValue()
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	close(slow)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "the slow secret is read once")
+}
+
+func TestValueFromProvider(t *testing.T) {
+	provider, err := ValueFrom{Environment: "TEST_ENV"}.Provider()
+	require.NoError(t, err)
+	assert.Equal(t, EnvironmentSource("TEST_ENV"), provider)
+
+	provider, err = ValueFrom{Vault: &VaultSource{Path: "secret/my-app", Key: "password"}}.Provider()
+	require.NoError(t, err)
+	assert.Equal(t, VaultSource{Path: "secret/my-app", Key: "password"}, provider)
+
+	_, err = ValueFrom{}.Provider()
+	assert.EqualError(t, err, "no source specified for ValueFrom")
+}
+
+func TestOverrideBuildArgDotenv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(file, []byte("TAG=1.2.3\n"), 0o600))
+	override := Override{Value: Value{ValueFrom: &ValueFrom{Dotenv: &DotenvSource{File: file, Key: "TAG"}}}, Target: "image.tag"}
+
+	arg, err := override.BuildArg()
+	require.NoError(t, err)
+	assert.Equal(t, "set", arg.Name)
+	assert.Equal(t, "image.tag=1.2.3", arg.Value)
+	assert.True(t, arg.ValueSecret)
+}
+
+func TestSecretValidate(t *testing.T) {
+	username, password := "robot", "token"
+	registry := &DockerRegistry{Server: "ghcr.io", Username: &Value{Value: &username}, Password: &Value{Value: &password}}
+
+	for _, tc := range []struct {
+		name   string
+		secret Secret
+		err    string
+	}{
+		{"opaque", Secret{Data: map[string]string{"password": "PASSWORD_ENV"}}, ""},
+		{"no data", Secret{}, "no data"},
+		{"duplicate key", Secret{Data: map[string]string{"a": "A_ENV"}, DataFrom: map[string]ValueFrom{"a": {File: "a"}}}, `key "a" is set in both data and dataFrom`},
+		{"tls", Secret{Type: "kubernetes.io/tls", DataFrom: map[string]ValueFrom{"tls.crt": {File: "tls.crt"}, "tls.key": {File: "tls.key"}}}, ""},
+		{"tls missing key", Secret{Type: "kubernetes.io/tls", DataFrom: map[string]ValueFrom{"tls.crt": {File: "tls.crt"}}}, `type kubernetes.io/tls requires key "tls.key"`},
+		{"docker registry", Secret{DockerRegistry: registry}, ""},
+		{"docker registry wrong type", Secret{Type: "Opaque", DockerRegistry: registry}, "dockerRegistry requires type kubernetes.io/dockerconfigjson"},
+		{"docker registry duplicate key", Secret{DockerRegistry: registry, Data: map[string]string{".dockerconfigjson": "CONFIG_ENV"}}, `key ".dockerconfigjson" cannot be set together with dockerRegistry`},
+		{"docker registry incomplete", Secret{DockerRegistry: &DockerRegistry{Server: "ghcr.io"}}, "dockerRegistry requires server, username and password"},
+		{"restart on change", Secret{Data: map[string]string{"a": "A_ENV"}, RestartOnChange: []string{"deployment/web", "StatefulSet/db"}}, ""},
+		{"restart on change without kind", Secret{Data: map[string]string{"a": "A_ENV"}, RestartOnChange: []string{"web"}}, `restartOnChange: invalid workload "web", must be <kind>/<name>`},
+		{"restart on change unknown kind", Secret{Data: map[string]string{"a": "A_ENV"}, RestartOnChange: []string{"cronjob/backup"}}, `restartOnChange: invalid workload "cronjob/backup", kind must be deployment, daemonset or statefulset`},
+		{"dockerconfigjson without registry", Secret{Type: SecretTypeDockerConfigJSON, Data: map[string]string{"other": "OTHER_ENV"}}, `type kubernetes.io/dockerconfigjson requires key ".dockerconfigjson"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.secret.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestDockerRegistryDockerConfigJSON(t *testing.T) {
+	t.Setenv("REGISTRY_PASSWORD", "s3cret")
+	username := "robot"
+	registry := DockerRegistry{
+		Server:   "ghcr.io",
+		Username: &Value{Value: &username},
+		Password: &Value{ValueFrom: &ValueFrom{Environment: "REGISTRY_PASSWORD"}},
+		Email:    "robot@example.com",
+	}
+
+	config, err := registry.DockerConfigJSON()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths":{"ghcr.io":{"username":"robot","password":"s3cret","email":"robot@example.com","auth":"cm9ib3Q6czNjcmV0"}}}`, string(config))
+
+	registry.Password = &Value{}
+	_, err = registry.DockerConfigJSON()
+	assert.EqualError(t, err, "could not get registry password: no value provided")
+}
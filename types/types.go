@@ -1,80 +1,388 @@
 package types
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/target/impeller/utils/commandbuilder"
+	"github.com/target/impeller/utils/readiness"
 )
 
 type ClusterConfig struct {
-	Name     string     `yaml:"name"`
-	Releases []Release  `yaml:"releases"`
-	Helm     HelmConfig `yaml:"helm"`
+	Name         string            `yaml:"name" description:"Name of the cluster, used to find cluster-specific values files"`
+	Releases     []Release         `yaml:"releases" description:"Releases installed in the cluster"`
+	Helm         HelmConfig        `yaml:"helm" description:"Helm settings for all releases"`
+	Extends      string            `yaml:"extends,omitempty" description:"Path, relative to this file, of a base cluster config this config is merged into"`
+	Vars         map[string]string `yaml:"vars,omitempty" description:"Variables referenced as ${NAME} from any string value in the cluster config"`
+	Groups       []string          `yaml:"groups,omitempty" description:"Groups the cluster belongs to, e.g. prod, sharing values files values/<release>/<group>.yaml"`
+	ValuesDir    string            `yaml:"valuesDir,omitempty" description:"Directory of per-release values files, relative to the cluster config file, ./values by default"`
+	ValuesLayers []string          `yaml:"valuesLayers,omitempty" description:"Order values files are layered in, later layers take precedence: default, valueFiles, groups and cluster"`
+	ReleasesDir  string            `yaml:"releasesDir,omitempty" description:"Release catalog directory, relative to the cluster config file; by default the nearest releases directory next to the cluster config file or in one of its parent directories"`
 }
 
+// DefaultValuesLayers is the order values files are layered in when a
+// cluster config does not set valuesLayers.
+var DefaultValuesLayers = []string{"default", "valueFiles", "groups", "cluster"}
+
 type HelmRepo struct {
-	Name     string `yaml:"name"`
-	URL      string `yaml:"url"`
-	Username *Value `yaml:"username,omitempty"`
-	Password *Value `yaml:"password,omitempty"`
+	Name     string `yaml:"name" jsonschema:"required" description:"Name of the Helm repo, used as prefix in chartPath"`
+	URL      string `yaml:"url" jsonschema:"required" description:"URL of the Helm repo"`
+	Username *Value `yaml:"username,omitempty" description:"Username for the Helm repo"`
+	Password *Value `yaml:"password,omitempty" description:"Password for the Helm repo"`
 }
 
 type Release struct {
-	Name               string     `yaml:"name"`
-	DeploymentMethod   string     `yaml:"deploymentMethod,omitempty"`
-	Version            string     `yaml:"version"`
-	ChartPath          string     `yaml:"chartPath"`
-	ChartsSource       string     `yaml:"chartsSource"`
-	History            uint       `yaml:history`
-	Overrides          []Override `yaml:"overrides,omitempty"`
-	Namespace          string     `yaml:"namespace,omitempty"`
-	ValueFiles         []string   `yaml:"valueFiles,omitempty"`
-	WaitforDeployment  []string   `yaml:"waitforDeployment,omitempty"`
-	WaitforDaemonSet   []string   `yaml:"waitforDaemonSet,omitempty"`
-	WaitforStatefulSet []string   `yaml:"waitforStatefulSet,omitempty"`
-	KubectlFiles []string   `yaml:"kubectlFiles,omitempty"`
-	Secrets      []Secret   `yaml:"secrets,omitempty"`
-	Force        bool       `yaml:"force,omitempty"`
+	Name               string                 `yaml:"name" jsonschema:"required" description:"Name of the Helm release"`
+	From               string                 `yaml:"from,omitempty" description:"Name of the release catalog definition, releases/<from>.yaml, the release is based on"`
+	DeploymentMethod   string                 `yaml:"deploymentMethod,omitempty" description:"How the chart is installed: helm (default) or kubectl"`
+	Version            string                 `yaml:"version" description:"Chart version or version constraint, as accepted by helm --version"`
+	ChartPath          string                 `yaml:"chartPath" description:"Chart reference, e.g. repo/chart, or path to a local chart"`
+	ChartsSource       string                 `yaml:"chartsSource" description:"URL of a charts tar archive downloaded and extracted into ./downloads"`
+	History            uint                   `yaml:"history" description:"Maximum number of release revisions kept by Helm"`
+	Overrides          []Override             `yaml:"overrides,omitempty" description:"Individual chart values set with --set or --set-file"`
+	Values             map[string]interface{} `yaml:"values,omitempty" description:"Chart values passed to Helm as a values file, taking precedence over values files"`
+	Namespace          string                 `yaml:"namespace,omitempty" description:"Namespace the release is installed in"`
+	ValueFiles         []string               `yaml:"valueFiles,omitempty" description:"Additional values files passed to Helm"`
+	WaitforDeployment  []WaitEntry            `yaml:"waitforDeployment,omitempty" description:"Deployments to wait for after installing the release, by name or with a timeout"`
+	WaitforDaemonSet   []WaitEntry            `yaml:"waitforDaemonSet,omitempty" description:"DaemonSets to wait for after installing the release, by name or with a timeout"`
+	WaitforStatefulSet []WaitEntry            `yaml:"waitforStatefulSet,omitempty" description:"StatefulSets to wait for after installing the release, by name or with a timeout"`
+	WaitFor            []WaitFor              `yaml:"waitFor,omitempty" description:"Resources of any kind to wait for after installing the release"`
+	WaitForAll         bool                   `yaml:"waitForAll,omitempty" description:"Wait for every Deployment, StatefulSet, DaemonSet and Job rendered by the chart"`
+	WaitTimeout        Duration               `yaml:"waitTimeout,omitempty" description:"How long to wait for each resource of the release to be ready, e.g. 10m"`
+	PollInterval       Duration               `yaml:"pollInterval,omitempty" description:"How often resources of the release are checked while waiting, e.g. 5s"`
+	KubectlFiles       []string               `yaml:"kubectlFiles,omitempty" description:"Manifest files or directories applied with kubectl after the release is ready"`
+	Secrets            []Secret               `yaml:"secrets,omitempty" description:"Secrets created or updated after the release is ready"`
+	ConfigMaps         []ConfigMap            `yaml:"configMaps,omitempty" description:"ConfigMaps created or updated after the release is ready"`
+	Force              bool                   `yaml:"force,omitempty" description:"Recreate resources when immutable fields change"`
+	DependsOn          []string               `yaml:"dependsOn,omitempty" description:"Names of releases which must be installed before this release"`
+	Absent             bool                   `yaml:"absent,omitempty" description:"Removes a release inherited from a base cluster config"`
+	Labels             map[string]string      `yaml:"labels,omitempty" description:"Labels used to select releases with --selector"`
+	Enabled            *bool                  `yaml:"enabled,omitempty" description:"Set to false to skip the release, true by default"`
+	When               string                 `yaml:"when,omitempty" description:"Condition the release is only installed if true, e.g. cluster.vars.region == \"us-east\""`
+}
+
+// WaitFor is a resource waited for until it is ready, using the readiness
+// rule of its kind or a status condition.
+type WaitFor struct {
+	Kind         string   `yaml:"kind" jsonschema:"required" description:"Resource type as accepted by kubectl get, e.g. job, pvc or certificates.cert-manager.io"`
+	Name         string   `yaml:"name" jsonschema:"required" description:"Name of the resource"`
+	Namespace    string   `yaml:"namespace,omitempty" description:"Namespace of the resource, defaults to the release namespace"`
+	Condition    string   `yaml:"condition,omitempty" description:"Status condition to wait for, as Type or Type=Status, instead of the readiness rule of the kind"`
+	Timeout      Duration `yaml:"timeout,omitempty" description:"How long to wait for the resource, overriding the waitTimeout of the release"`
+	PollInterval Duration `yaml:"pollInterval,omitempty" description:"How often the resource is checked, overriding the pollInterval of the release"`
+}
+
+// Validate checks that the kind, name and condition are valid.
+func (w WaitFor) Validate() error {
+	if w.Kind == "" || w.Name == "" {
+		return fmt.Errorf("kind and name are required")
+	}
+	if w.Condition != "" {
+		if _, _, err := readiness.ParseCondition(w.Condition); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Timeout.Get(); err != nil {
+		return fmt.Errorf("timeout: %v", err)
+	}
+	if _, err := w.PollInterval.Get(); err != nil {
+		return fmt.Errorf("pollInterval: %v", err)
+	}
+	return nil
+}
+
+// WaitEntry is an entry of the waitforDeployment, waitforDaemonSet and
+// waitforStatefulSet lists of a release. It is written as the name of the
+// workload, or as a mapping to give the workload its own timeout.
+type WaitEntry struct {
+	Name         string   `yaml:"name" jsonschema:"required" description:"Name of the workload"`
+	Timeout      Duration `yaml:"timeout,omitempty" description:"How long to wait for the workload, overriding the waitTimeout of the release"`
+	PollInterval Duration `yaml:"pollInterval,omitempty" description:"How often the workload is checked, overriding the pollInterval of the release"`
+}
+
+// UnmarshalYAML accepts the name of the workload alone as well as a
+// mapping.
+func (w *WaitEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*w = WaitEntry{Name: name}
+		return nil
+	}
+	type plain WaitEntry
+	return unmarshal((*plain)(w))
+}
+
+// MarshalYAML writes entries without a timeout or poll interval as the name
+// alone.
+func (w WaitEntry) MarshalYAML() (interface{}, error) {
+	if w.Timeout == "" && w.PollInterval == "" {
+		return w.Name, nil
+	}
+	type plain WaitEntry
+	return plain(w), nil
+}
+
+// WaitFor returns the wait for the workload of the given kind.
+func (w WaitEntry) WaitFor(kind string) WaitFor {
+	return WaitFor{Kind: kind, Name: w.Name, Timeout: w.Timeout, PollInterval: w.PollInterval}
+}
+
+// Duration is a duration as accepted by time.ParseDuration, e.g. 90s or
+// 10m.
+type Duration string
+
+// Get returns the duration, or 0 if it is not set.
+func (d Duration) Get() (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(string(d))
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration \"%s\", must be positive, e.g. 90s or 10m", d)
+	}
+	return duration, nil
 }
 
 type Secret struct {
-	Name      string            `yaml:"name"`
-	Namespace string            `yaml:"namespace,omitempty"`
-	Data      map[string]string `yaml:"data,omitempty"`
+	Name            string               `yaml:"name" jsonschema:"required" description:"Name of the secret"`
+	Namespace       string               `yaml:"namespace,omitempty" description:"Namespace of the secret, defaults to the release namespace"`
+	Type            string               `yaml:"type,omitempty" description:"Type of the secret, e.g. kubernetes.io/tls, Opaque by default"`
+	Labels          map[string]string    `yaml:"labels,omitempty" description:"Labels of the secret"`
+	Annotations     map[string]string    `yaml:"annotations,omitempty" description:"Annotations of the secret"`
+	Immutable       bool                 `yaml:"immutable,omitempty" description:"Marks the secret immutable; its data cannot be changed once created"`
+	Data            map[string]string    `yaml:"data,omitempty" description:"Secret keys mapped to names of environment variables ending with _ENV"`
+	DataFrom        map[string]ValueFrom `yaml:"dataFrom,omitempty" description:"Secret keys mapped to the source of their value, e.g. a file or a Vault secret"`
+	DockerRegistry  *DockerRegistry      `yaml:"dockerRegistry,omitempty" description:"Registry credentials the .dockerconfigjson of a kubernetes.io/dockerconfigjson secret is generated from"`
+	RestartOnChange []string             `yaml:"restartOnChange,omitempty" description:"Workloads in the namespace of the secret restarted when its content changes, e.g. deployment/my-app"`
+}
+
+// ConfigMap is a ConfigMap managed alongside a release. Unlike secrets, its
+// data is not sensitive and is printed on dry and diff runs.
+type ConfigMap struct {
+	Name        string               `yaml:"name" jsonschema:"required" description:"Name of the ConfigMap"`
+	Namespace   string               `yaml:"namespace,omitempty" description:"Namespace of the ConfigMap, defaults to the release namespace"`
+	Labels      map[string]string    `yaml:"labels,omitempty" description:"Labels of the ConfigMap"`
+	Annotations map[string]string    `yaml:"annotations,omitempty" description:"Annotations of the ConfigMap"`
+	Immutable   bool                 `yaml:"immutable,omitempty" description:"Marks the ConfigMap immutable; its data cannot be changed once created"`
+	Data        map[string]string    `yaml:"data,omitempty" description:"Literal values of ConfigMap keys"`
+	DataFrom    map[string]ValueFrom `yaml:"dataFrom,omitempty" description:"ConfigMap keys mapped to the source of their value, e.g. an environment variable or a file"`
+	Directories []string             `yaml:"directories,omitempty" description:"Directories whose files are added as keys named after the files"`
+}
+
+// Validate checks that the ConfigMap has data and that no key is set twice.
+// Keys read from directories are checked when the ConfigMap is built.
+func (c ConfigMap) Validate() error {
+	for key := range c.DataFrom {
+		if _, ok := c.Data[key]; ok {
+			return fmt.Errorf("key \"%s\" is set in both data and dataFrom", key)
+		}
+	}
+	if len(c.Data) == 0 && len(c.DataFrom) == 0 && len(c.Directories) == 0 {
+		return fmt.Errorf("no data")
+	}
+	return nil
+}
+
+// DockerRegistry holds the credentials of an image pull secret.
+type DockerRegistry struct {
+	Server   string `yaml:"server" jsonschema:"required" description:"Registry server, e.g. https://index.docker.io/v1/ or ghcr.io"`
+	Username *Value `yaml:"username" jsonschema:"required" description:"Registry username"`
+	Password *Value `yaml:"password" jsonschema:"required" description:"Registry password or token"`
+	Email    string `yaml:"email,omitempty" description:"Email address of the registry user"`
+}
+
+const (
+	SecretTypeOpaque           = "Opaque"
+	SecretTypeDockerConfigJSON = "kubernetes.io/dockerconfigjson"
+)
+
+// secretTypeKeys lists the keys Kubernetes requires for built-in secret
+// types.
+var secretTypeKeys = map[string][]string{
+	"kubernetes.io/tls":              {"tls.crt", "tls.key"},
+	"kubernetes.io/dockerconfigjson": {".dockerconfigjson"},
+	"kubernetes.io/dockercfg":        {".dockercfg"},
+	"kubernetes.io/ssh-auth":         {"ssh-privatekey"},
+}
+
+// SecretType returns the type of the secret: the configured type,
+// kubernetes.io/dockerconfigjson for dockerRegistry secrets, or Opaque.
+func (s Secret) SecretType() string {
+	switch {
+	case s.Type != "":
+		return s.Type
+	case s.DockerRegistry != nil:
+		return SecretTypeDockerConfigJSON
+	default:
+		return SecretTypeOpaque
+	}
+}
+
+// Validate checks that the secret has data, that no key is set twice and
+// that the keys required by its type are set.
+func (s Secret) Validate() error {
+	keys := map[string]bool{}
+	for key := range s.Data {
+		keys[key] = true
+	}
+	for key := range s.DataFrom {
+		if keys[key] {
+			return fmt.Errorf("key \"%s\" is set in both data and dataFrom", key)
+		}
+		keys[key] = true
+	}
+	if s.DockerRegistry != nil {
+		if s.SecretType() != SecretTypeDockerConfigJSON {
+			return fmt.Errorf("dockerRegistry requires type %s", SecretTypeDockerConfigJSON)
+		}
+		if keys[".dockerconfigjson"] {
+			return fmt.Errorf("key \".dockerconfigjson\" cannot be set together with dockerRegistry")
+		}
+		if s.DockerRegistry.Server == "" || s.DockerRegistry.Username == nil || s.DockerRegistry.Password == nil {
+			return fmt.Errorf("dockerRegistry requires server, username and password")
+		}
+		keys[".dockerconfigjson"] = true
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no data")
+	}
+	for _, key := range secretTypeKeys[s.SecretType()] {
+		if !keys[key] {
+			return fmt.Errorf("type %s requires key \"%s\"", s.SecretType(), key)
+		}
+	}
+	for _, workload := range s.RestartOnChange {
+		if _, _, err := ParseWorkload(workload); err != nil {
+			return fmt.Errorf("restartOnChange: %v", err)
+		}
+	}
+	return nil
+}
+
+// ParseWorkload splits a workload reference such as deployment/my-app into
+// its kind and name. Only kinds which can be restarted and waited for are
+// accepted.
+func ParseWorkload(workload string) (kind, name string, err error) {
+	parts := strings.SplitN(workload, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid workload \"%s\", must be <kind>/<name>", workload)
+	}
+	kind, name = strings.ToLower(parts[0]), parts[1]
+	switch kind {
+	case "deployment", "daemonset", "statefulset":
+		return kind, name, nil
+	}
+	return "", "", fmt.Errorf("invalid workload \"%s\", kind must be deployment, daemonset or statefulset", workload)
+}
+
+// DockerConfigJSON returns the .dockerconfigjson of the registry
+// credentials.
+func (r DockerRegistry) DockerConfigJSON() ([]byte, error) {
+	username, err := r.Username.GetValue()
+	if err != nil {
+		return nil, fmt.Errorf("could not get registry username: %v", err)
+	}
+	password, err := r.Password.GetValue()
+	if err != nil {
+		return nil, fmt.Errorf("could not get registry password: %v", err)
+	}
+	type auth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email,omitempty"`
+		Auth     string `json:"auth"`
+	}
+	return json.Marshal(map[string]map[string]auth{
+		"auths": {
+			r.Server: {
+				Username: username,
+				Password: password,
+				Email:    r.Email,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			},
+		},
+	})
 }
 
 type Override struct {
 	Value  `yaml:",inline"`
-	Target string `yaml:"target"`
+	Target string `yaml:"target" jsonschema:"required" description:"Chart value to set, e.g. image.tag"`
+	As     string `yaml:"as,omitempty" description:"How Helm parses the value: auto (default, --set or --set-file), string (--set-string), json (--set-json) or literal (--set-literal)"`
+}
+
+// overrideFlags maps the `as` modes of an override to Helm flags.
+var overrideFlags = map[string]string{
+	"":        "set",
+	"auto":    "set",
+	"string":  "set-string",
+	"json":    "set-json",
+	"literal": "set-literal",
 }
 
-// BuildArg creates a commandbuilder.Arg for either a `--set` or
-// `--set-file` argument. If the value is provided directly or as an
-// environment variable, `--set` will be used. If a file is provided,
-// then `--set-file` will be used.
+// BuildArg creates a commandbuilder.Arg for the override. By default, or
+// with `as: auto`, a `--set` argument is created if the value is provided
+// directly or as an environment variable, and `--set-file` if a file is
+// provided. With `as: string`, `json` or `literal` the value, or the file's
+// contents, is set with `--set-string`, `--set-json` or `--set-literal`.
 func (o Override) BuildArg() (*commandbuilder.Arg, error) {
-	return o.Value.BuildArg(o.Target)
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	flag := overrideFlags[o.As]
+	if flag == "set" {
+		return o.Value.BuildArg(o.Target)
+	}
+
+	value, err := o.Value.GetValue()
+	if err != nil {
+		return nil, err
+	}
+	if o.As == "json" && !json.Valid([]byte(value)) {
+		return nil, fmt.Errorf("value of \"%s\" is not valid JSON", o.Target)
+	}
+	return &commandbuilder.Arg{
+		Type:        commandbuilder.ArgTypeLongParam,
+		Name:        flag,
+		Value:       fmt.Sprintf("%s=%s", o.Target, value),
+		ValueSecret: !o.ShowValue,
+	}, nil
+}
+
+// Validate checks the `as` mode of the override and, for JSON values given
+// directly, that they parse.
+func (o Override) Validate() error {
+	if _, ok := overrideFlags[o.As]; !ok {
+		return fmt.Errorf("invalid as \"%s\" for \"%s\", must be auto, string, json or literal", o.As, o.Target)
+	}
+	if o.As == "json" && o.Value.Value != nil && !json.Valid([]byte(*o.Value.Value)) {
+		return fmt.Errorf("value of \"%s\" is not valid JSON", o.Target)
+	}
+	return nil
 }
 
 type HelmConfig struct {
-	Upgrade             bool              `yaml:"upgrade"`
-	SkipSetupHelmRepo   bool              `yaml:"skipSetupHelmRepo"`
-	SkipSetupKubeConfig bool              `yaml:"skipSetupKubeConfig"`
-	DefaultHistory      uint              `yaml:"defaultHistory"`
-	Debug               bool              `yaml:"debug"`
-	LogLevel            uint              `yaml:"log"`
-	ServiceAccount      string            `yaml:"serviceAccount"`
-	Repos               []HelmRepo        `yaml:"repos"`
-	Overrides           map[string]string `yaml:"overrides"`
+	Upgrade             *bool             `yaml:"upgrade" description:"Upgrade existing releases, true by default; false only installs releases which do not exist yet"`
+	SkipSetupHelmRepo   bool              `yaml:"skipSetupHelmRepo" description:"Skip adding and updating the configured Helm repos"`
+	SkipSetupKubeConfig bool              `yaml:"skipSetupKubeConfig" description:"Skip setting up the kubeconfig and installing releases"`
+	DefaultHistory      uint              `yaml:"defaultHistory" description:"Default maximum number of release revisions kept by Helm"`
+	Debug               bool              `yaml:"debug" description:"Enable Helm debug output"`
+	LogLevel            uint              `yaml:"log" description:"Helm log level"`
+	ServiceAccount      string            `yaml:"serviceAccount" description:"Service account Helm and kubectl impersonate, as namespace/name or name in the release namespace"`
+	Repos               []HelmRepo        `yaml:"repos" description:"Helm repos added before installing releases"`
+	Overrides           map[string]string `yaml:"overrides" description:"Chart values set with --set for every release, overridden by release overrides"`
+	Parallelism         int               `yaml:"parallelism" description:"Maximum number of releases installed concurrently"`
+	WaitTimeout         Duration          `yaml:"waitTimeout" description:"Default time to wait for each resource to be ready, e.g. 10m"`
+	PollInterval        Duration          `yaml:"pollInterval" description:"Default interval resources are checked at while waiting, e.g. 5s"`
 }
 
 type Value struct {
-	Value     *string    `yaml:"value,omitempty"`
-	ValueFrom *ValueFrom `yaml:"valueFrom,omitempty"`
-	ShowValue bool       `yaml:"showValue"`
+	Value     *string    `yaml:"value,omitempty" jsonschema:"oneof=value" description:"Literal value"`
+	ValueFrom *ValueFrom `yaml:"valueFrom,omitempty" jsonschema:"oneof=value" description:"Source the value is read from"`
+	ShowValue bool       `yaml:"showValue" description:"Print the value in logs instead of redacting it"`
 }
 
 func (v Value) BuildArg(name string) (*commandbuilder.Arg, error) {
@@ -108,46 +416,90 @@ func (v Value) GetValue() (string, error) {
 }
 
 type ValueFrom struct {
-	Environment string `yaml:"environment"`
-	File        string `yaml:"file"`
+	Environment string        `yaml:"environment" jsonschema:"oneof=source" description:"Name of the environment variable holding the value"`
+	File        string        `yaml:"file" jsonschema:"oneof=source" description:"Path of the file holding the value"`
+	Dotenv      *DotenvSource `yaml:"dotenv,omitempty" jsonschema:"oneof=source" description:"Variable of a dotenv file holding the value"`
+	Vault       *VaultSource  `yaml:"vault,omitempty" jsonschema:"oneof=source" description:"Key of a HashiCorp Vault KV v2 secret holding the value"`
+}
+
+// Provider returns the SecretProvider of the configured source.
+func (vf ValueFrom) Provider() (SecretProvider, error) {
+	switch {
+	case vf.Environment != "":
+		return EnvironmentSource(vf.Environment), nil
+	case vf.File != "":
+		return FileSource(vf.File), nil
+	case vf.Dotenv != nil:
+		return *vf.Dotenv, nil
+	case vf.Vault != nil:
+		return *vf.Vault, nil
+	}
+	return nil, fmt.Errorf("no source specified for ValueFrom")
 }
 
+// BuildArg creates a `--set-file` argument for files and a `--set`
+// argument with the value read from any other source.
 func (vf ValueFrom) BuildArg(name string, show bool) (*commandbuilder.Arg, error) {
-	if vf.Environment != "" {
-		value, err := vf.GetValue()
-		if err != nil {
-			return nil, err
-		}
-		if value == "" {
-			log.Println("WARNING: Override value is blank.")
-		}
-		return &commandbuilder.Arg{
-			Type:        commandbuilder.ArgTypeLongParam,
-			Name:        "set",
-			Value:       fmt.Sprintf("%s=%s", name, value),
-			ValueSecret: !show,
-		}, nil
-	} else if vf.File != "" {
+	if vf.File != "" {
 		return &commandbuilder.Arg{
 			Type:        commandbuilder.ArgTypeLongParam,
 			Name:        "set-file",
 			Value:       fmt.Sprintf("%s=%s", name, vf.File),
 			ValueSecret: false,
 		}, nil
-	} else {
-		return nil, fmt.Errorf("no source specified for ValueFrom")
 	}
+	value, err := vf.GetValue()
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		log.Println("WARNING: Override value is blank.")
+	}
+	return &commandbuilder.Arg{
+		Type:        commandbuilder.ArgTypeLongParam,
+		Name:        "set",
+		Value:       fmt.Sprintf("%s=%s", name, value),
+		ValueSecret: !show,
+	}, nil
 }
 
 func (vf ValueFrom) GetValue() (string, error) {
-	if vf.Environment != "" {
-		return os.Getenv(vf.Environment), nil
-	} else if vf.File != "" {
-		bytes, err := ioutil.ReadFile(vf.File)
-		if err != nil {
-			return "", err
+	provider, err := vf.Provider()
+	if err != nil {
+		return "", err
+	}
+	return provider.GetValue()
+}
+
+// FleetConfig describes how the clusters of a fleet deployment are reached.
+type FleetConfig struct {
+	Parallelism int            `yaml:"parallelism" description:"Maximum number of clusters deployed at once, all clusters if 0"`
+	Clusters    []FleetCluster `yaml:"clusters" description:"Kubernetes contexts of the clusters"`
+}
+
+// FleetCluster maps a cluster config, by its name, to a Kubernetes context.
+type FleetCluster struct {
+	Name        string `yaml:"name" jsonschema:"required" description:"Name of the cluster config"`
+	KubeContext string `yaml:"kubeContext" description:"Kubernetes context used to deploy the cluster, defaults to the cluster name"`
+}
+
+// KubeContext returns the Kubernetes context configured for a cluster. If
+// the cluster is not listed, its name is used as context.
+func (f FleetConfig) KubeContext(cluster string) string {
+	for _, c := range f.Clusters {
+		if c.Name == cluster && c.KubeContext != "" {
+			return c.KubeContext
 		}
-		return string(bytes), nil
 	}
-	return "", fmt.Errorf("no source specified for ValueFrom")
+	return cluster
+}
+
+// ConditionVars returns the identifiers available in release `when`
+// conditions: cluster.name and cluster.vars.<name> for every variable.
+func (c ClusterConfig) ConditionVars() map[string]string {
+	vars := map[string]string{"cluster.name": c.Name}
+	for name, value := range c.Vars {
+		vars["cluster.vars."+name] = value
+	}
+	return vars
 }
@@ -2,6 +2,7 @@ package types
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -71,3 +72,63 @@ func TestOverrideBuildArgFile(t *testing.T) {
 		ValueSecret: false,
 	}, arg)
 }
+
+func TestOverrideBuildArgAs(t *testing.T) {
+	for as, flag := range map[string]string{
+		"auto":    "set",
+		"string":  "set-string",
+		"json":    "set-json",
+		"literal": "set-literal",
+	} {
+		value := `{"zone":"0123"}`
+		override := Override{Value: Value{Value: &value}, Target: "servers[0].zones[0]", As: as}
+
+		arg, err := override.BuildArg()
+		require.NoError(t, err, as)
+		assert.Equal(t, &commandbuilder.Arg{
+			Type:        commandbuilder.ArgTypeLongParam,
+			Name:        flag,
+			Value:       `servers[0].zones[0]={"zone":"0123"}`,
+			ValueSecret: true,
+		}, arg, as)
+	}
+}
+
+func TestOverrideBuildArgAsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zones.json")
+	require.NoError(t, os.WriteFile(file, []byte(`["a","b"]`), 0o644))
+	override := Override{Value: Value{ValueFrom: &ValueFrom{File: file}, ShowValue: true}, Target: "zones", As: "json"}
+
+	arg, err := override.BuildArg()
+	require.NoError(t, err)
+	assert.Equal(t, &commandbuilder.Arg{
+		Type:        commandbuilder.ArgTypeLongParam,
+		Name:        "set-json",
+		Value:       `zones=["a","b"]`,
+		ValueSecret: false,
+	}, arg)
+}
+
+func TestOverrideBuildArgAsInvalid(t *testing.T) {
+	value := "{zones: [}"
+	_, err := Override{Value: Value{Value: &value}, Target: "zones", As: "json"}.BuildArg()
+	assert.EqualError(t, err, `value of "zones" is not valid JSON`)
+
+	t.Setenv("TEST_JSON_ENV", "not json")
+	_, err = Override{Value: Value{ValueFrom: &ValueFrom{Environment: "TEST_JSON_ENV"}}, Target: "zones", As: "json"}.BuildArg()
+	assert.EqualError(t, err, `value of "zones" is not valid JSON`)
+
+	_, err = Override{Value: Value{Value: &value}, Target: "zones", As: "yaml"}.BuildArg()
+	assert.EqualError(t, err, `invalid as "yaml" for "zones", must be auto, string, json or literal`)
+}
+
+func TestFleetConfigKubeContext(t *testing.T) {
+	fleet := FleetConfig{
+		Clusters: []FleetCluster{
+			{Name: "cluster1-lab", KubeContext: "lab-context"},
+		},
+	}
+
+	assert.Equal(t, "lab-context", fleet.KubeContext("cluster1-lab"))
+	assert.Equal(t, "cluster1-prod", fleet.KubeContext("cluster1-prod"))
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/target/impeller/types"
+	"gopkg.in/yaml.v2"
+)
+
+// ReleaseCatalogDir is the name of the release catalog directory. Every file
+// releases/<name>.yaml defines a release which cluster configs reference
+// with `from: <name>`. Unless a cluster config sets releasesDir, the nearest
+// releases directory next to the cluster config file or in one of its
+// parent directories is used, see findReleaseCatalogDir.
+const ReleaseCatalogDir = "releases"
+
+// catalogOverridableKeys are the keys a release referencing the catalog may
+// set: version, namespace, overrides and values change the definition, the
+// others select the release in a cluster. The rest of the release definition
+// comes from the catalog only.
+var catalogOverridableKeys = map[string]bool{
+	"name":      true,
+	"from":      true,
+	"version":   true,
+	"namespace": true,
+	"overrides": true,
+	"values":    true,
+	"dependsOn": true,
+	"labels":    true,
+	"enabled":   true,
+	"when":      true,
+	"absent":    true,
+}
+
+// overridableKeys returns the sorted catalogOverridableKeys.
+func overridableKeys() []string {
+	keys := make([]string, 0, len(catalogOverridableKeys))
+	for key := range catalogOverridableKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findReleaseCatalogDir returns the nearest releases directory in the
+// directory of a cluster config file or one of its parents. If there is
+// none, the releases directory next to the cluster config file is returned.
+func findReleaseCatalogDir(configPath string) string {
+	dir, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		return filepath.Join(filepath.Dir(configPath), ReleaseCatalogDir)
+	}
+	for {
+		candidate := filepath.Join(dir, ReleaseCatalogDir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return filepath.Join(filepath.Dir(configPath), ReleaseCatalogDir)
+		}
+		dir = parent
+	}
+}
+
+// ReadReleaseCatalog reads the catalog definition of a release from the
+// catalog of a cluster config, with variable references resolved the same
+// way as in the cluster config.
+func ReadReleaseCatalog(config types.ClusterConfig, name string) (release types.Release, err error) {
+	var sources []yamlSource
+	raw, err := readReleaseCatalogMap(config.ReleasesDir, name, &sources)
+	if err != nil {
+		return
+	}
+	var errs []string
+	interpolateValue(raw, "", varLookup(config.Vars), &errs)
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return release, fmt.Errorf("Error interpolating release catalog \"%s\": %s", name, strings.Join(errs, "; "))
+	}
+	source := sources[0]
+	if err = validateYAMLVariables(source.path, source.data, source.t, varLookup(config.Vars)); err != nil {
+		return release, fmt.Errorf("Error decoding release catalog \"%s\": %v", name, err)
+	}
+	coerceScalars(raw, reflect.TypeOf(release))
+	out, err := yaml.Marshal(raw)
+	if err != nil {
+		return release, fmt.Errorf("Error decoding release catalog \"%s\": %v", name, err)
+	}
+	if err = yaml.Unmarshal(out, &release); err != nil {
+		return release, fmt.Errorf("Error decoding release catalog \"%s\": %v", name, err)
+	}
+	return
+}
+
+// readReleaseCatalogMap reads the catalog definition of a release into a
+// generic map and adds the file to sources.
+func readReleaseCatalogMap(dir, name string, sources *[]yamlSource) (map[interface{}]interface{}, error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid release catalog name \"%s\"", name)
+	}
+	path := filepath.Join(dir, name+".yaml")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening release catalog \"%s\": %v", name, err)
+	}
+	if err := validateYAML(path, data, reflect.TypeOf(types.Release{})); err != nil {
+		return nil, fmt.Errorf("Error decoding release catalog \"%s\": %v", name, err)
+	}
+
+	*sources = append(*sources, yamlSource{path: path, data: data, t: reflect.TypeOf(types.Release{})})
+
+	raw := map[interface{}]interface{}{}
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Error decoding release catalog \"%s\": %v", name, err)
+	}
+	if _, ok := raw["from"]; ok {
+		return nil, fmt.Errorf("Error decoding release catalog \"%s\": catalog releases cannot use from", name)
+	}
+	return raw, nil
+}
+
+// resolveReleaseCatalog replaces every release of a raw cluster config which
+// references the catalog with `from` by the catalog definition, merged with
+// the keys the release sets. Only catalogOverridableKeys may be set;
+// overrides are merged by target and values are deep-merged. Definitions are
+// read from the catalog directory dir and added to sources.
+func resolveReleaseCatalog(raw map[interface{}]interface{}, dir string, sources *[]yamlSource) error {
+	releases, ok := raw["releases"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	catalog := map[string]map[interface{}]interface{}{}
+	for i, value := range releases {
+		release, ok := value.(map[interface{}]interface{})
+		if !ok || release["from"] == nil || isAbsent(release) {
+			continue
+		}
+		name := fmt.Sprint(release["from"])
+
+		var invalid []string
+		for key := range release {
+			if !catalogOverridableKeys[fmt.Sprint(key)] {
+				invalid = append(invalid, fmt.Sprint(key))
+			}
+		}
+		if len(invalid) > 0 {
+			sort.Strings(invalid)
+			return fmt.Errorf("release \"%v\": %s cannot be set for a release from the catalog, only %s can be set", release["name"], strings.Join(invalid, ", "), strings.Join(overridableKeys(), ", "))
+		}
+
+		definition, ok := catalog[name]
+		if !ok {
+			var err error
+			if definition, err = readReleaseCatalogMap(dir, name, sources); err != nil {
+				return fmt.Errorf("release \"%v\": %v", release["name"], err)
+			}
+			catalog[name] = definition
+		}
+
+		releases[i] = mergeMaps(definition, release, func(key, baseValue, childValue interface{}) (interface{}, bool) {
+			if key != "overrides" {
+				return nil, false
+			}
+			baseOverrides, ok := baseValue.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			childOverrides, ok := childValue.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			return mergeOverrides(baseOverrides, childOverrides), true
+		})
+	}
+	return nil
+}
+
+// mergeOverrides merges release overrides by target; an override in child
+// replaces the base override with the same target.
+func mergeOverrides(base, child []interface{}) []interface{} {
+	merged := append([]interface{}{}, base...)
+	for _, childValue := range child {
+		childOverride, ok := childValue.(map[interface{}]interface{})
+		index := -1
+		for i, baseValue := range merged {
+			if baseOverride, isMap := baseValue.(map[interface{}]interface{}); ok && isMap && baseOverride["target"] == childOverride["target"] {
+				index = i
+				break
+			}
+		}
+		if index >= 0 {
+			merged[index] = childValue
+		} else {
+			merged = append(merged, childValue)
+		}
+	}
+	return merged
+}
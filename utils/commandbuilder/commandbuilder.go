@@ -1,7 +1,9 @@
 package commandbuilder
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -19,6 +21,15 @@ const (
 type CommandBuilder struct {
 	Name  string
 	Parts []Arg
+
+	// Logger, Stdout and Stderr are optional. When unset, the standard
+	// logger, os.Stdout and os.Stderr are used.
+	Logger *log.Logger
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env holds additional "KEY=value" environment variables for the
+	// command on top of the current process environment.
+	Env []string
 }
 
 func (cb *CommandBuilder) SafeString() string {
@@ -30,12 +41,29 @@ func (cb *CommandBuilder) SafeString() string {
 }
 
 func (cb *CommandBuilder) Command() *exec.Cmd {
+	return cb.CommandContext(context.Background())
+}
+
+// CommandContext is like Command but the command is killed when ctx is
+// done.
+func (cb *CommandBuilder) CommandContext(ctx context.Context) *exec.Cmd {
 	args := []string{}
 	for _, arg := range cb.Parts {
 		args = append(args, arg.UnsafeParts()...)
 	}
-	log.Printf("RUNNING: %s", cb.SafeString())
-	return exec.Command(cb.Name, args...)
+	cb.logger().Printf("RUNNING: %s", cb.SafeString())
+	cmd := exec.CommandContext(ctx, cb.Name, args...)
+	if len(cb.Env) > 0 {
+		cmd.Env = append(os.Environ(), cb.Env...)
+	}
+	return cmd
+}
+
+func (cb *CommandBuilder) logger() *log.Logger {
+	if cb.Logger != nil {
+		return cb.Logger
+	}
+	return log.Default()
 }
 
 func (cb *CommandBuilder) Add(args ...Arg) {
@@ -44,8 +72,14 @@ func (cb *CommandBuilder) Add(args ...Arg) {
 
 func (cb *CommandBuilder) Run() error {
 	cmd := cb.Command()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = cb.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = cb.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
 	return cmd.Run()
 }
 
@@ -0,0 +1,221 @@
+package condition
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Evaluate evaluates a boolean expression such as
+//
+//	cluster.vars.region == "us-east" && !(cluster.name == "lab")
+//
+// Supported are string literals in single or double quotes, true and false,
+// identifiers looked up in vars, the operators ==, !=, &&, || and !, and
+// parentheses. Referencing an identifier which is not in vars is an error.
+func Evaluate(expr string, vars map[string]string) (bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition \"%s\": %v", expr, err)
+	}
+	p := parser{tokens: tokens, vars: vars}
+	value, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected \"%s\"", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid condition \"%s\": %v", expr, err)
+	}
+	result, err := value.bool()
+	if err != nil {
+		return false, fmt.Errorf("invalid condition \"%s\": %v", expr, err)
+	}
+	return result, nil
+}
+
+const (
+	tokenOperator = iota
+	tokenString
+	tokenIdentifier
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+func tokenize(expr string) (tokens []token, err error) {
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!=") ||
+			strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, token{kind: tokenOperator, text: expr[i : i+2]})
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, token{kind: tokenOperator, text: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexRune(expr[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[i+1 : i+1+end]})
+			i += end + 2
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(expr) && (expr[i] == '_' || expr[i] == '.' || expr[i] == '-' ||
+				unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: expr[start:i]})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c'", c)
+		}
+	}
+	return tokens, nil
+}
+
+type value struct {
+	isBool bool
+	b      bool
+	s      string
+}
+
+func (v value) bool() (bool, error) {
+	if v.isBool {
+		return v.b, nil
+	}
+	switch v.s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("\"%s\" is not a boolean", v.s)
+}
+
+func (v value) String() string {
+	if v.isBool {
+		return fmt.Sprint(v.b)
+	}
+	return v.s
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	vars   map[string]string
+}
+
+func (p *parser) accept(operator string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator && p.tokens[p.pos].text == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (value, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right value
+		if right, err = p.and(); err != nil {
+			break
+		}
+		left, err = logical(left, right, func(a, b bool) bool { return a || b })
+	}
+	return left, err
+}
+
+func (p *parser) and() (value, error) {
+	left, err := p.unary()
+	for err == nil && p.accept("&&") {
+		var right value
+		if right, err = p.unary(); err != nil {
+			break
+		}
+		left, err = logical(left, right, func(a, b bool) bool { return a && b })
+	}
+	return left, err
+}
+
+func (p *parser) unary() (value, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return value{}, err
+		}
+		b, err := operand.bool()
+		return value{isBool: true, b: !b}, err
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (value, error) {
+	left, err := p.primary()
+	if err != nil {
+		return value{}, err
+	}
+	for _, operator := range []string{"==", "!="} {
+		if p.accept(operator) {
+			right, err := p.primary()
+			if err != nil {
+				return value{}, err
+			}
+			equal := left.String() == right.String()
+			return value{isBool: true, b: equal == (operator == "==")}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) primary() (value, error) {
+	if p.pos >= len(p.tokens) {
+		return value{}, fmt.Errorf("unexpected end of expression")
+	}
+	if p.accept("(") {
+		v, err := p.or()
+		if err != nil {
+			return value{}, err
+		}
+		if !p.accept(")") {
+			return value{}, fmt.Errorf("missing \")\"")
+		}
+		return v, nil
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenString:
+		return value{s: t.text}, nil
+	case tokenIdentifier:
+		switch t.text {
+		case "true":
+			return value{isBool: true, b: true}, nil
+		case "false":
+			return value{isBool: true, b: false}, nil
+		}
+		v, ok := p.vars[t.text]
+		if !ok {
+			return value{}, fmt.Errorf("undefined identifier \"%s\"", t.text)
+		}
+		return value{s: v}, nil
+	}
+	return value{}, fmt.Errorf("unexpected \"%s\"", t.text)
+}
+
+func logical(left, right value, op func(a, b bool) bool) (value, error) {
+	a, err := left.bool()
+	if err != nil {
+		return value{}, err
+	}
+	b, err := right.bool()
+	if err != nil {
+		return value{}, err
+	}
+	return value{isBool: true, b: op(a, b)}, nil
+}
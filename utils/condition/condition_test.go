@@ -0,0 +1,49 @@
+package condition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	vars := map[string]string{
+		"cluster.name":         "cluster1-prod",
+		"cluster.vars.region":  "us-east",
+		"cluster.vars.enabled": "true",
+	}
+
+	for expr, expected := range map[string]bool{
+		`cluster.vars.region == "us-east"`:                                    true,
+		`cluster.vars.region != 'us-east'`:                                    false,
+		`cluster.vars.region == "us-east" && cluster.name == "cluster1-lab"`:  false,
+		`cluster.vars.region == "us-west" || cluster.name == "cluster1-prod"`: true,
+		`!(cluster.name == "cluster1-lab")`:                                   true,
+		`cluster.vars.enabled`:                                                true,
+		`!cluster.vars.enabled || false`:                                      false,
+		`true`:                                                                true,
+	} {
+		result, err := Evaluate(expr, vars)
+		require.NoErrorf(t, err, "evaluating %s", expr)
+		assert.Equalf(t, expected, result, "evaluating %s", expr)
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	vars := map[string]string{"cluster.name": "cluster1-prod"}
+
+	for expr, message := range map[string]string{
+		`cluster.vars.region == "us-east"`: `undefined identifier "cluster.vars.region"`,
+		`cluster.name`:                     `"cluster1-prod" is not a boolean`,
+		`cluster.name == "x`:               `unterminated string`,
+		`(cluster.name == "x"`:             `missing ")"`,
+		`cluster.name ==`:                  `unexpected end of expression`,
+		`cluster.name == "x" "y"`:          `unexpected "y"`,
+		`cluster.name = "x"`:               `unexpected character '='`,
+	} {
+		_, err := Evaluate(expr, vars)
+		require.Errorf(t, err, "evaluating %s", expr)
+		assert.Contains(t, err.Error(), message)
+	}
+}
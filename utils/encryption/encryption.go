@@ -0,0 +1,202 @@
+// Package encryption encrypts the values of YAML files, such as Helm values
+// files, so they can be committed. Like SOPS, only the values are encrypted;
+// keys, the structure and comments stay readable. Every scalar value is
+// replaced by
+//
+//	ENC[AES256_GCM,data:<base64>,iv:<base64>,tag:<base64>,type:<type>]
+//
+// using AES-256-GCM with the value's path in the document, e.g.
+// database.hosts[0], as additional data so values cannot be moved around.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const (
+	// KeyEnv holds the base64-encoded 32 byte key.
+	KeyEnv = "IMPELLER_VALUES_KEY"
+	// KeyFileEnv holds the path of a file containing the base64-encoded key.
+	KeyFileEnv = "IMPELLER_VALUES_KEY_FILE"
+
+	keySize     = 32
+	tagSize     = 16
+	valuePrefix = "ENC[AES256_GCM,"
+)
+
+var valuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:([A-Za-z0-9+/=]*),iv:([A-Za-z0-9+/=]+),tag:([A-Za-z0-9+/=]+),type:([a-z]+)\]$`)
+
+// GenerateKey returns a new random key, base64-encoded.
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// LoadKey returns the key from the IMPELLER_VALUES_KEY environment variable
+// or from the file named by IMPELLER_VALUES_KEY_FILE.
+func LoadKey() ([]byte, error) {
+	encoded := os.Getenv(KeyEnv)
+	if encoded == "" {
+		path := os.Getenv(KeyFileEnv)
+		if path == "" {
+			return nil, fmt.Errorf("no encryption key: set %s or %s", KeyEnv, KeyFileEnv)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading encryption key: %v", err)
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("invalid encryption key: must be %d bytes, base64-encoded", keySize)
+	}
+	return key, nil
+}
+
+// IsEncrypted reports whether a YAML file contains encrypted values.
+func IsEncrypted(data []byte) bool {
+	return bytes.Contains(data, []byte(valuePrefix))
+}
+
+// Encrypt encrypts every scalar value of a YAML document which is not
+// encrypted yet. Null values are left as they are.
+func Encrypt(data, key []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return transform(data, func(node *yamlv3.Node, path string) error {
+		if node.Tag == "!!null" || valuePattern.MatchString(node.Value) {
+			return nil
+		}
+		iv := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(iv); err != nil {
+			return err
+		}
+		sealed := aead.Seal(nil, iv, []byte(node.Value), []byte(path))
+		ciphertext, tag := sealed[:len(sealed)-tagSize], sealed[len(sealed)-tagSize:]
+		node.Value = fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+			base64.StdEncoding.EncodeToString(ciphertext),
+			base64.StdEncoding.EncodeToString(iv),
+			base64.StdEncoding.EncodeToString(tag),
+			valueType(node))
+		node.Tag = "!!str"
+		node.Style = 0
+		return nil
+	})
+}
+
+// Decrypt decrypts every encrypted value of a YAML document.
+func Decrypt(data, key []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return transform(data, func(node *yamlv3.Node, path string) error {
+		match := valuePattern.FindStringSubmatch(node.Value)
+		if match == nil {
+			return nil
+		}
+		var parts [3][]byte
+		for i := range parts {
+			if parts[i], err = base64.StdEncoding.DecodeString(match[i+1]); err != nil {
+				return fmt.Errorf("invalid encrypted value at %s: %v", path, err)
+			}
+		}
+		ciphertext, iv, tag := parts[0], parts[1], parts[2]
+		if len(iv) != aead.NonceSize() {
+			return fmt.Errorf("invalid encrypted value at %s: bad iv", path)
+		}
+		plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(path))
+		if err != nil {
+			return fmt.Errorf("could not decrypt value at %s: wrong key or modified value", path)
+		}
+		node.Value = string(plaintext)
+		node.Tag = "!!" + match[4]
+		node.Style = 0
+		return nil
+	})
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// valueType returns the YAML type of a scalar restored on decryption.
+func valueType(node *yamlv3.Node) string {
+	switch tag := node.ShortTag(); tag {
+	case "!!int", "!!float", "!!bool", "!!timestamp", "!!binary":
+		return strings.TrimPrefix(tag, "!!")
+	default:
+		return "str"
+	}
+}
+
+// transform parses a YAML document, calls fn for every scalar value with
+// its path and returns the re-encoded document.
+func transform(data []byte, fn func(node *yamlv3.Node, path string) error) ([]byte, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+	if err := walk(doc.Content[0], "", fn); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	encoder := yamlv3.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func walk(node *yamlv3.Node, path string, fn func(node *yamlv3.Node, path string) error) error {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			if err := walk(node.Content[i+1], key, fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.SequenceNode:
+		for i, item := range node.Content {
+			if err := walk(item, fmt.Sprintf("%s[%d]", path, i), fn); err != nil {
+				return err
+			}
+		}
+	case yamlv3.ScalarNode:
+		return fn(node, path)
+	}
+	return nil
+}
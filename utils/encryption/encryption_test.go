@@ -0,0 +1,93 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const values = `# database credentials
+database:
+  user: app
+  password: hunter2
+  port: 5432
+  tls: true
+  zip: "0123"
+hosts:
+  - a.example.com
+  - b.example.com
+empty: null
+`
+
+func testKey(t *testing.T) []byte {
+	encoded, err := GenerateKey()
+	require.NoError(t, err)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := testKey(t)
+
+	encrypted, err := Encrypt([]byte(values), key)
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(encrypted))
+	assert.False(t, IsEncrypted([]byte(values)))
+	for _, plaintext := range []string{"hunter2", "5432", "a.example.com", "0123"} {
+		assert.NotContains(t, string(encrypted), plaintext)
+	}
+	assert.Contains(t, string(encrypted), "# database credentials")
+	assert.Contains(t, string(encrypted), "  password: ENC[AES256_GCM,")
+	assert.Contains(t, string(encrypted), "empty: null")
+
+	// Values which are already encrypted are kept.
+	again, err := Encrypt(encrypted, key)
+	require.NoError(t, err)
+	assert.Equal(t, string(encrypted), string(again))
+
+	decrypted, err := Decrypt(encrypted, key)
+	require.NoError(t, err)
+	assert.Equal(t, values, string(decrypted))
+}
+
+func TestDecryptErrors(t *testing.T) {
+	key := testKey(t)
+	encrypted, err := Encrypt([]byte("a: secret\nb: other\n"), key)
+	require.NoError(t, err)
+
+	_, err = Decrypt(encrypted, testKey(t))
+	assert.EqualError(t, err, "could not decrypt value at a: wrong key or modified value")
+
+	// A value moved to another key does not decrypt.
+	lines := strings.Split(string(encrypted), "\n")
+	swapped := "a: " + strings.TrimPrefix(lines[1], "b: ") + "\nb: " + strings.TrimPrefix(lines[0], "a: ") + "\n"
+	_, err = Decrypt([]byte(swapped), key)
+	assert.EqualError(t, err, "could not decrypt value at a: wrong key or modified value")
+}
+
+func TestLoadKey(t *testing.T) {
+	encoded, err := GenerateKey()
+	require.NoError(t, err)
+
+	t.Setenv(KeyEnv, "")
+	t.Setenv(KeyFileEnv, "")
+	_, err = LoadKey()
+	assert.EqualError(t, err, "no encryption key: set IMPELLER_VALUES_KEY or IMPELLER_VALUES_KEY_FILE")
+
+	file := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(file, []byte(encoded+"\n"), 0o600))
+	t.Setenv(KeyFileEnv, file)
+	key, err := LoadKey()
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	t.Setenv(KeyEnv, base64.StdEncoding.EncodeToString([]byte("too short")))
+	_, err = LoadKey()
+	assert.EqualError(t, err, "invalid encryption key: must be 32 bytes, base64-encoded")
+}
@@ -0,0 +1,147 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graph is a directed dependency graph. Nodes are identified by the index
+// returned from AddNode; names are only used in error messages, so several
+// nodes may share the same name.
+type Graph struct {
+	names []string
+	deps  [][]int
+}
+
+// New returns an empty Graph.
+func New() *Graph {
+	return &Graph{}
+}
+
+// AddNode adds a node to the graph and returns its index.
+func (g *Graph) AddNode(name string) int {
+	g.names = append(g.names, name)
+	g.deps = append(g.deps, nil)
+	return len(g.names) - 1
+}
+
+// AddDependency records that node depends on dependency, i.e. dependency
+// must be handled before node.
+func (g *Graph) AddDependency(node, dependency int) {
+	for _, d := range g.deps[node] {
+		if d == dependency {
+			return
+		}
+	}
+	g.deps[node] = append(g.deps[node], dependency)
+}
+
+// Len returns the number of nodes in the graph.
+func (g *Graph) Len() int {
+	return len(g.names)
+}
+
+// Name returns the name of a node.
+func (g *Graph) Name(node int) string {
+	return g.names[node]
+}
+
+// Dependencies returns the nodes that node directly depends on.
+func (g *Graph) Dependencies(node int) []int {
+	return g.deps[node]
+}
+
+// Dependents returns the nodes that directly depend on node.
+func (g *Graph) Dependents(node int) (dependents []int) {
+	for i, deps := range g.deps {
+		for _, d := range deps {
+			if d == node {
+				dependents = append(dependents, i)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Sort returns the nodes in topological order. Among nodes whose
+// dependencies are satisfied the one added first wins, so a graph without
+// edges keeps its insertion order. If the graph contains a cycle, an error
+// naming the nodes of the cycle is returned.
+func (g *Graph) Sort() ([]int, error) {
+	if cycle := g.findCycle(); cycle != nil {
+		names := make([]string, len(cycle))
+		for i, node := range cycle {
+			names[i] = g.names[node]
+		}
+		return nil, fmt.Errorf("dependency cycle detected: %s", strings.Join(names, " -> "))
+	}
+
+	done := make([]bool, len(g.names))
+	order := make([]int, 0, len(g.names))
+	for len(order) < len(g.names) {
+		for i := range g.names {
+			if done[i] || !g.ready(i, done) {
+				continue
+			}
+			done[i] = true
+			order = append(order, i)
+			break
+		}
+	}
+	return order, nil
+}
+
+func (g *Graph) ready(node int, done []bool) bool {
+	for _, d := range g.deps[node] {
+		if !done[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// findCycle returns the nodes of the first cycle found, starting and ending
+// with the same node, or nil if the graph is acyclic.
+func (g *Graph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.names))
+	var stack []int
+
+	var visit func(node int) []int
+	visit = func(node int) []int {
+		state[node] = visiting
+		stack = append(stack, node)
+		for _, d := range g.deps[node] {
+			switch state[d] {
+			case visiting:
+				for i, n := range stack {
+					if n == d {
+						cycle := append([]int{}, stack[i:]...)
+						return append(cycle, d)
+					}
+				}
+			case unvisited:
+				if cycle := visit(d); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[node] = visited
+		return nil
+	}
+
+	for i := range g.names {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortKeepsInsertionOrderWithoutDependencies(t *testing.T) {
+	g := New()
+	g.AddNode("a")
+	g.AddNode("b")
+	g.AddNode("c")
+
+	order, err := g.Sort()
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, order)
+}
+
+func TestSortDependencies(t *testing.T) {
+	g := New()
+	apps := g.AddNode("apps")
+	ingress := g.AddNode("ingress")
+	certManager := g.AddNode("cert-manager")
+	g.AddDependency(apps, ingress)
+	g.AddDependency(ingress, certManager)
+
+	order, err := g.Sort()
+	require.NoError(t, err)
+	assert.Equal(t, []int{certManager, ingress, apps}, order)
+	assert.Equal(t, []int{ingress}, g.Dependencies(apps))
+	assert.Equal(t, []int{apps}, g.Dependents(ingress))
+}
+
+func TestSortCycle(t *testing.T) {
+	g := New()
+	a := g.AddNode("a")
+	b := g.AddNode("b")
+	c := g.AddNode("c")
+	g.AddNode("d")
+	g.AddDependency(a, b)
+	g.AddDependency(b, c)
+	g.AddDependency(c, a)
+
+	_, err := g.Sort()
+	require.Error(t, err)
+	assert.Equal(t, "dependency cycle detected: a -> b -> c -> a", err.Error())
+}
+
+func TestSortSelfDependency(t *testing.T) {
+	g := New()
+	a := g.AddNode("a")
+	g.AddDependency(a, a)
+
+	_, err := g.Sort()
+	require.Error(t, err)
+	assert.Equal(t, "dependency cycle detected: a -> a", err.Error())
+}
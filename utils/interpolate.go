@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// variablePattern matches ${NAME} and ${NAME:-default}. A leading $$ escapes
+// the reference, so $${NAME} results in a literal ${NAME}.
+var variablePattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Interpolate replaces ${NAME} and ${NAME:-default} references in s with
+// values returned by lookup. References to undefined variables without a
+// default are left untouched and their names are returned.
+func Interpolate(s string, lookup func(name string) (string, bool)) (string, []string) {
+	var undefined []string
+	result := variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := variablePattern.FindStringSubmatch(match)
+		if groups[1] == "$" {
+			return match[1:]
+		}
+		if value, ok := lookup(groups[2]); ok {
+			return value
+		}
+		if groups[3] != "" {
+			return groups[4]
+		}
+		undefined = append(undefined, groups[2])
+		return match
+	})
+	return result, undefined
+}
+
+// interpolateClusterConfig resolves variable references in every string
+// value of a raw cluster config. Variables are looked up in the `vars` block
+// first and in the environment second. Values in the `vars` block may only
+// reference environment variables.
+func interpolateClusterConfig(raw map[interface{}]interface{}) error {
+	var errs []string
+	vars := map[string]string{}
+
+	if rawVars, ok := raw["vars"].(map[interface{}]interface{}); ok {
+		resolved := map[interface{}]interface{}{}
+		for key, value := range rawVars {
+			name := fmt.Sprint(key)
+			interpolated, undefined := Interpolate(fmt.Sprint(value), os.LookupEnv)
+			for _, variable := range undefined {
+				errs = append(errs, fmt.Sprintf("undefined variable \"%s\" in \"vars.%s\"", variable, name))
+			}
+			vars[name] = interpolated
+			resolved[key] = interpolated
+		}
+		raw["vars"] = resolved
+	}
+
+	lookup := varLookup(vars)
+	for key, value := range raw {
+		if key == "vars" {
+			continue
+		}
+		raw[key] = interpolateValue(value, fmt.Sprint(key), lookup, &errs)
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// varLookup looks variables up in the resolved vars of a cluster config
+// first and in the environment second.
+func varLookup(vars map[string]string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		if value, ok := vars[name]; ok {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	}
+}
+
+func interpolateValue(value interface{}, path string, lookup func(string) (string, bool), errs *[]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		interpolated, undefined := Interpolate(v, lookup)
+		for _, variable := range undefined {
+			*errs = append(*errs, fmt.Sprintf("undefined variable \"%s\" in \"%s\"", variable, path))
+		}
+		return interpolated
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			v[key] = interpolateValue(item, joinPath(path, fmt.Sprint(key)), lookup, errs)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateValue(item, fmt.Sprintf("%s[%d]", path, i), lookup, errs)
+		}
+		return v
+	default:
+		return value
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+// mergeClusterConfigs deep-merges a child cluster config into its base.
+// Maps are merged recursively with values from the child taking precedence,
+// any other value (including lists) in the child replaces the base value.
+// Releases are the exception: they are matched by name, so a child only has
+// to specify the fields it changes, e.g. `version`. A child release with
+// `absent: true` removes the release from the result; child releases not
+// found in the base are appended.
+func mergeClusterConfigs(base, child map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := mergeMaps(base, child, func(key interface{}, baseValue, childValue interface{}) (interface{}, bool) {
+		if key != "releases" {
+			return nil, false
+		}
+		baseReleases, ok := baseValue.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		childReleases, ok := childValue.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		return mergeReleases(baseReleases, childReleases), true
+	})
+	return merged
+}
+
+// mergeMaps merges child into a copy of base. custom may handle the merge
+// of a key present in both maps; it returns false to use the default rules.
+func mergeMaps(base, child map[interface{}]interface{}, custom func(key, baseValue, childValue interface{}) (interface{}, bool)) map[interface{}]interface{} {
+	merged := make(map[interface{}]interface{}, len(base)+len(child))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, childValue := range child {
+		baseValue, ok := merged[key]
+		if !ok {
+			merged[key] = childValue
+			continue
+		}
+		if custom != nil {
+			if value, ok := custom(key, baseValue, childValue); ok {
+				merged[key] = value
+				continue
+			}
+		}
+		baseMap, baseIsMap := baseValue.(map[interface{}]interface{})
+		childMap, childIsMap := childValue.(map[interface{}]interface{})
+		if baseIsMap && childIsMap {
+			merged[key] = mergeMaps(baseMap, childMap, nil)
+		} else {
+			merged[key] = childValue
+		}
+	}
+	return merged
+}
+
+func mergeReleases(base, child []interface{}) []interface{} {
+	merged := append([]interface{}{}, base...)
+	for _, childValue := range child {
+		childRelease, ok := childValue.(map[interface{}]interface{})
+		if !ok {
+			merged = append(merged, childValue)
+			continue
+		}
+
+		index := -1
+		for i, baseValue := range merged {
+			if baseRelease, ok := baseValue.(map[interface{}]interface{}); ok && baseRelease["name"] == childRelease["name"] {
+				index = i
+				break
+			}
+		}
+
+		switch {
+		case isAbsent(childRelease) && index >= 0:
+			merged = append(merged[:index], merged[index+1:]...)
+		case isAbsent(childRelease):
+		case index >= 0:
+			merged[index] = mergeMaps(merged[index].(map[interface{}]interface{}), childRelease, nil)
+		default:
+			merged = append(merged, childRelease)
+		}
+	}
+	return merged
+}
+
+func isAbsent(release map[interface{}]interface{}) bool {
+	absent, _ := release["absent"].(bool)
+	return absent
+}
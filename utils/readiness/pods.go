@@ -0,0 +1,168 @@
+package readiness
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CrashLoopRestarts is the number of restarts after which a container in
+// CrashLoopBackOff is considered broken rather than still starting up.
+const CrashLoopRestarts = 3
+
+// fatalReasons are waiting reasons of containers which do not resolve
+// without a change to the workload.
+var fatalReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// PodError describes a container which will not become ready.
+type PodError struct {
+	Pod       string
+	Container string
+	Reason    string
+	Message   string
+}
+
+func (e *PodError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("pod %s container %s: %s", e.Pod, e.Container, e.Reason)
+	}
+	return fmt.Sprintf("pod %s container %s: %s: %s", e.Pod, e.Container, e.Reason, e.Message)
+}
+
+// HasPods reports whether a kind has pods which CheckPod applies to.
+func HasPods(kind string) bool {
+	switch NormalizeKind(kind) {
+	case "deployment", "daemonset", "statefulset", "job":
+		return true
+	}
+	return false
+}
+
+// CheckPod returns a PodError if a container of the pod failed in a way
+// which does not resolve by waiting: the image cannot be pulled, the
+// container cannot be created from its config, or it keeps crashing.
+func CheckPod(pod map[string]interface{}) error {
+	name, _ := field(pod, "metadata", "name").(string)
+	for _, statuses := range []string{"initContainerStatuses", "containerStatuses"} {
+		items, _ := field(pod, "status", statuses).([]interface{})
+		for _, item := range items {
+			status, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			reason, _ := field(status, "state", "waiting", "reason").(string)
+			message, _ := field(status, "state", "waiting", "message").(string)
+			container, _ := status["name"].(string)
+			switch {
+			case fatalReasons[reason]:
+				return &PodError{Pod: name, Container: container, Reason: reason, Message: message}
+			case reason == "CrashLoopBackOff" && integer(status, "restartCount") >= CrashLoopRestarts:
+				return &PodError{Pod: name, Container: container, Reason: reason, Message: lastTermination(status)}
+			}
+		}
+	}
+	return nil
+}
+
+// lastTermination describes why a crashing container last terminated.
+func lastTermination(status map[string]interface{}) string {
+	terminated, _ := field(status, "lastState", "terminated").(map[string]interface{})
+	reason, _ := terminated["reason"].(string)
+	message := fmt.Sprintf("restarted %d times", integer(status, "restartCount"))
+	if reason != "" {
+		message += fmt.Sprintf(", last terminated with %s (exit code %d)", reason, integer(terminated, "exitCode"))
+	}
+	return message
+}
+
+// Selector returns the label selector of a workload's spec.selector in the
+// syntax of kubectl --selector.
+func Selector(object map[string]interface{}) (string, error) {
+	selector, _ := field(object, "spec", "selector").(map[string]interface{})
+	var requirements []string
+	matchLabels, _ := selector["matchLabels"].(map[string]interface{})
+	for key, value := range matchLabels {
+		requirements = append(requirements, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(requirements)
+
+	expressions, _ := selector["matchExpressions"].([]interface{})
+	for _, item := range expressions {
+		expression, _ := item.(map[string]interface{})
+		key, _ := expression["key"].(string)
+		operator, _ := expression["operator"].(string)
+		var values []string
+		items, _ := expression["values"].([]interface{})
+		for _, value := range items {
+			values = append(values, fmt.Sprint(value))
+		}
+		switch operator {
+		case "In":
+			requirements = append(requirements, fmt.Sprintf("%s in (%s)", key, strings.Join(values, ",")))
+		case "NotIn":
+			requirements = append(requirements, fmt.Sprintf("%s notin (%s)", key, strings.Join(values, ",")))
+		case "Exists":
+			requirements = append(requirements, key)
+		case "DoesNotExist":
+			requirements = append(requirements, "!"+key)
+		default:
+			return "", fmt.Errorf("unsupported selector operator \"%s\"", operator)
+		}
+	}
+	if len(requirements) == 0 {
+		return "", fmt.Errorf("workload has no selector")
+	}
+	return strings.Join(requirements, ","), nil
+}
+
+// DeploymentTemplateHash returns the pod-template-hash of the ReplicaSet of
+// the current revision of a deployment, or "" if it does not exist yet.
+func DeploymentTemplateHash(deployment map[string]interface{}, replicaSets []map[string]interface{}) string {
+	revision, _ := field(deployment, "metadata", "annotations", "deployment.kubernetes.io/revision").(string)
+	if revision == "" {
+		return ""
+	}
+	for _, replicaSet := range replicaSets {
+		if field(replicaSet, "metadata", "annotations", "deployment.kubernetes.io/revision") == revision {
+			hash, _ := field(replicaSet, "metadata", "labels", "pod-template-hash").(string)
+			return hash
+		}
+	}
+	return ""
+}
+
+// CurrentPods returns the pods of a workload which belong to its current
+// revision, so broken pods of a previous rollout which are being replaced
+// do not fail the wait. For deployments, templateHash is the result of
+// DeploymentTemplateHash; no pods are returned without it.
+func CurrentPods(kind string, object map[string]interface{}, pods []map[string]interface{}, templateHash string) []map[string]interface{} {
+	var label, value string
+	switch NormalizeKind(kind) {
+	case "deployment":
+		if templateHash == "" {
+			return nil
+		}
+		label, value = "pod-template-hash", templateHash
+	case "statefulset":
+		label = "controller-revision-hash"
+		value, _ = field(object, "status", "updateRevision").(string)
+	case "daemonset":
+		label, value = "pod-template-generation", fmt.Sprint(integer(object, "metadata", "generation"))
+	}
+	if label == "" || value == "" {
+		return pods
+	}
+
+	var current []map[string]interface{}
+	for _, pod := range pods {
+		if field(pod, "metadata", "labels", label) == value {
+			current = append(current, pod)
+		}
+	}
+	return current
+}
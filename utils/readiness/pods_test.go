@@ -0,0 +1,69 @@
+package readiness
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPod(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pod      string
+		expected string
+	}{
+		{"running", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"app","state":{"running":{}}}]}}`, ""},
+		{"starting", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"app","state":{"waiting":{"reason":"ContainerCreating"}}}]}}`, ""},
+		{"image pull", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"app","state":{"waiting":{"reason":"ErrImagePull","message":"manifest unknown"}}}]}}`, "pod web-1 container app: ErrImagePull: manifest unknown"},
+		{"image pull backoff", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"app","state":{"waiting":{"reason":"ImagePullBackOff"}}}]}}`, "pod web-1 container app: ImagePullBackOff"},
+		{"init container config", `{"metadata":{"name":"web-1"},"status":{"initContainerStatuses":[{"name":"migrate","state":{"waiting":{"reason":"CreateContainerConfigError","message":"secret \"db\" not found"}}}]}}`, `pod web-1 container migrate: CreateContainerConfigError: secret "db" not found`},
+		{"first crash", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"app","restartCount":1,"state":{"waiting":{"reason":"CrashLoopBackOff"}}}]}}`, ""},
+		{"crash loop", `{"metadata":{"name":"web-1"},"status":{"containerStatuses":[{"name":"sidecar","state":{"running":{}}},{"name":"app","restartCount":4,"state":{"waiting":{"reason":"CrashLoopBackOff"}},"lastState":{"terminated":{"reason":"Error","exitCode":2}}}]}}`, "pod web-1 container app: CrashLoopBackOff: restarted 4 times, last terminated with Error (exit code 2)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckPod(object(t, tc.pod))
+			if tc.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSelector(t *testing.T) {
+	selector, err := Selector(object(t, `{"spec":{"selector":{"matchLabels":{"app":"web","tier":"frontend"},"matchExpressions":[{"key":"env","operator":"In","values":["prod","staging"]},{"key":"canary","operator":"DoesNotExist"}]}}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "app=web,tier=frontend,env in (prod,staging),!canary", selector)
+
+	_, err = Selector(object(t, `{"spec":{}}`))
+	assert.EqualError(t, err, "workload has no selector")
+}
+
+func TestCurrentPods(t *testing.T) {
+	pods := []map[string]interface{}{
+		object(t, `{"metadata":{"name":"old","labels":{"pod-template-hash":"aaa","controller-revision-hash":"db-1","pod-template-generation":"1"}}}`),
+		object(t, `{"metadata":{"name":"new","labels":{"pod-template-hash":"bbb","controller-revision-hash":"db-2","pod-template-generation":"2"}}}`),
+	}
+	names := func(pods []map[string]interface{}) (names []string) {
+		for _, pod := range pods {
+			names = append(names, field(pod, "metadata", "name").(string))
+		}
+		return names
+	}
+
+	deployment := object(t, `{"metadata":{"annotations":{"deployment.kubernetes.io/revision":"2"}}}`)
+	replicaSets := []map[string]interface{}{
+		object(t, `{"metadata":{"annotations":{"deployment.kubernetes.io/revision":"1"},"labels":{"pod-template-hash":"aaa"}}}`),
+		object(t, `{"metadata":{"annotations":{"deployment.kubernetes.io/revision":"2"},"labels":{"pod-template-hash":"bbb"}}}`),
+	}
+	hash := DeploymentTemplateHash(deployment, replicaSets)
+	assert.Equal(t, "bbb", hash)
+	assert.Equal(t, []string{"new"}, names(CurrentPods("deployment", deployment, pods, hash)))
+	assert.Empty(t, CurrentPods("deployment", deployment, pods, ""))
+
+	assert.Equal(t, []string{"new"}, names(CurrentPods("sts", object(t, `{"status":{"updateRevision":"db-2"}}`), pods, "")))
+	assert.Equal(t, []string{"old"}, names(CurrentPods("daemonset", object(t, `{"metadata":{"generation":1}}`), pods, "")))
+	assert.Equal(t, []string{"old", "new"}, names(CurrentPods("job", object(t, `{}`), pods, "")))
+}
@@ -0,0 +1,294 @@
+// Package readiness decides whether Kubernetes objects, as returned by
+// `kubectl get -o json`, are ready. Workloads, Jobs, PersistentVolumeClaims,
+// Services, CustomResourceDefinitions and APIServices have built-in rules;
+// any other kind, such as a custom resource, is ready once a status
+// condition, Ready by default, is True.
+package readiness
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultCondition is the condition waited for on kinds without a built-in
+// rule.
+const DefaultCondition = "Ready"
+
+// Status is the readiness of an object. Message describes what is still
+// missing when the object is not ready.
+type Status struct {
+	Ready   bool
+	Message string
+}
+
+// kindAliases maps short names and plurals, as accepted by kubectl, to the
+// kinds with built-in rules.
+var kindAliases = map[string]string{
+	"deploy":                    "deployment",
+	"deployments":               "deployment",
+	"ds":                        "daemonset",
+	"daemonsets":                "daemonset",
+	"sts":                       "statefulset",
+	"statefulsets":              "statefulset",
+	"jobs":                      "job",
+	"pvc":                       "persistentvolumeclaim",
+	"persistentvolumeclaims":    "persistentvolumeclaim",
+	"svc":                       "service",
+	"services":                  "service",
+	"crd":                       "customresourcedefinition",
+	"crds":                      "customresourcedefinition",
+	"customresourcedefinitions": "customresourcedefinition",
+	"apiservices":               "apiservice",
+}
+
+var rules = map[string]func(object map[string]interface{}) (Status, error){
+	"deployment":               deploymentStatus,
+	"daemonset":                daemonSetStatus,
+	"statefulset":              statefulSetStatus,
+	"job":                      jobStatus,
+	"persistentvolumeclaim":    pvcStatus,
+	"service":                  serviceStatus,
+	"customresourcedefinition": conditionRule("Established", "True"),
+	"apiservice":               conditionRule("Available", "True"),
+}
+
+// NormalizeKind returns the lower-case singular kind of a resource type as
+// accepted by kubectl, e.g. deploy, Deployment or deployments.apps.
+func NormalizeKind(kind string) string {
+	kind = strings.ToLower(kind)
+	if i := strings.Index(kind, "."); i >= 0 {
+		kind = kind[:i]
+	}
+	if alias, ok := kindAliases[kind]; ok {
+		return alias
+	}
+	return kind
+}
+
+// HasRule reports whether a kind has a built-in readiness rule.
+func HasRule(kind string) bool {
+	_, ok := rules[NormalizeKind(kind)]
+	return ok
+}
+
+// ParseCondition parses a condition of the form Type or Type=Status. The
+// status defaults to True.
+func ParseCondition(condition string) (conditionType, status string, err error) {
+	parts := strings.SplitN(condition, "=", 2)
+	conditionType = strings.TrimSpace(parts[0])
+	status = "True"
+	if len(parts) == 2 {
+		status = strings.TrimSpace(parts[1])
+	}
+	if conditionType == "" || status == "" || strings.ContainsAny(conditionType+status, " =") {
+		return "", "", fmt.Errorf("invalid condition \"%s\", must be <type> or <type>=<status>", condition)
+	}
+	return conditionType, status, nil
+}
+
+// Check returns the readiness of an object. If condition is set it replaces
+// the built-in rule of the kind. An error means the object failed and will
+// not become ready, e.g. a failed Job.
+func Check(kind string, object map[string]interface{}, condition string) (Status, error) {
+	if condition == "" {
+		if rule, ok := rules[NormalizeKind(kind)]; ok {
+			return rule(object)
+		}
+		condition = DefaultCondition
+	}
+	conditionType, status, err := ParseCondition(condition)
+	if err != nil {
+		return Status{}, err
+	}
+	return conditionRule(conditionType, status)(object)
+}
+
+func conditionRule(conditionType, status string) func(object map[string]interface{}) (Status, error) {
+	return func(object map[string]interface{}) (Status, error) {
+		if actual, _ := findCondition(object, conditionType); actual == status {
+			return Status{Ready: true}, nil
+		}
+		return Status{Message: fmt.Sprintf("waiting for condition %s=%s", conditionType, status)}, nil
+	}
+}
+
+// observed reports whether the controller has seen the latest spec of a
+// workload. Until then its status describes the previous rollout.
+func observed(object map[string]interface{}) bool {
+	observedGeneration := integer(object, "status", "observedGeneration")
+	return observedGeneration > 0 && observedGeneration >= integer(object, "metadata", "generation")
+}
+
+// replicas returns spec.replicas, which defaults to 1.
+func replicas(object map[string]interface{}) int64 {
+	if field(object, "spec", "replicas") == nil {
+		return 1
+	}
+	return integer(object, "spec", "replicas")
+}
+
+// deploymentStatus follows kubectl rollout status: the latest generation
+// is observed, all replicas are updated, old replicas are gone and the
+// updated replicas are available.
+func deploymentStatus(object map[string]interface{}) (Status, error) {
+	if !observed(object) {
+		return Status{Message: "waiting for the rollout to be observed"}, nil
+	}
+	if _, condition := findCondition(object, "Progressing"); condition != nil && condition["reason"] == "ProgressDeadlineExceeded" {
+		return Status{}, fmt.Errorf("rollout exceeded its progress deadline: %s", conditionMessage(condition))
+	}
+	desired := replicas(object)
+	updated := integer(object, "status", "updatedReplicas")
+	current := integer(object, "status", "replicas")
+	available := integer(object, "status", "availableReplicas")
+	switch {
+	case updated < desired:
+		return Status{Message: fmt.Sprintf("%d of %d new replicas updated", updated, desired)}, nil
+	case current > updated:
+		return Status{Message: fmt.Sprintf("%d old replicas pending termination", current-updated)}, nil
+	case available < updated:
+		return Status{Message: fmt.Sprintf("%d of %d updated replicas available", available, updated)}, nil
+	}
+	return Status{Ready: true}, nil
+}
+
+// daemonSetStatus follows kubectl rollout status: the latest generation is
+// observed and a pod was updated and is available on every node.
+func daemonSetStatus(object map[string]interface{}) (Status, error) {
+	if !observed(object) {
+		return Status{Message: "waiting for the rollout to be observed"}, nil
+	}
+	desired := integer(object, "status", "desiredNumberScheduled")
+	updated := integer(object, "status", "updatedNumberScheduled")
+	available := integer(object, "status", "numberAvailable")
+	if strategy, _ := field(object, "spec", "updateStrategy", "type").(string); strategy == "OnDelete" {
+		// Pods are only updated when deleted, so only availability counts.
+		updated = desired
+	}
+	switch {
+	case updated < desired:
+		return Status{Message: fmt.Sprintf("%d of %d new pods updated", updated, desired)}, nil
+	case available < desired:
+		return Status{Message: fmt.Sprintf("%d of %d updated pods available", available, desired)}, nil
+	}
+	return Status{Ready: true}, nil
+}
+
+// statefulSetStatus follows kubectl rollout status: the latest generation
+// is observed, all replicas are ready and the pods run the update
+// revision, except those below the partition of a partitioned rollout.
+func statefulSetStatus(object map[string]interface{}) (Status, error) {
+	if !observed(object) {
+		return Status{Message: "waiting for the rollout to be observed"}, nil
+	}
+	desired := replicas(object)
+	ready := integer(object, "status", "readyReplicas")
+	if ready < desired {
+		return Status{Message: fmt.Sprintf("%d of %d replicas ready", ready, desired)}, nil
+	}
+	if strategy, _ := field(object, "spec", "updateStrategy", "type").(string); strategy == "OnDelete" {
+		return Status{Ready: true}, nil
+	}
+	updated := integer(object, "status", "updatedReplicas")
+	if partition := integer(object, "spec", "updateStrategy", "rollingUpdate", "partition"); partition > 0 {
+		if updated < desired-partition {
+			return Status{Message: fmt.Sprintf("%d of %d new replicas updated", updated, desired-partition)}, nil
+		}
+		return Status{Ready: true}, nil
+	}
+	updateRevision, _ := field(object, "status", "updateRevision").(string)
+	currentRevision, _ := field(object, "status", "currentRevision").(string)
+	if updateRevision != currentRevision {
+		return Status{Message: fmt.Sprintf("%d of %d replicas updated to revision %s", updated, desired, updateRevision)}, nil
+	}
+	return Status{Ready: true}, nil
+}
+
+func jobStatus(object map[string]interface{}) (Status, error) {
+	if status, condition := findCondition(object, "Failed"); status == "True" {
+		return Status{}, fmt.Errorf("job failed: %s", conditionMessage(condition))
+	}
+	if status, _ := findCondition(object, "Complete"); status == "True" {
+		return Status{Ready: true}, nil
+	}
+	return Status{Message: fmt.Sprintf("%d active, %d succeeded", integer(object, "status", "active"), integer(object, "status", "succeeded"))}, nil
+}
+
+func pvcStatus(object map[string]interface{}) (Status, error) {
+	phase, _ := field(object, "status", "phase").(string)
+	if phase == "Bound" {
+		return Status{Ready: true}, nil
+	}
+	if phase == "" {
+		phase = "Unknown"
+	}
+	return Status{Message: fmt.Sprintf("phase is %s, waiting for Bound", phase)}, nil
+}
+
+// serviceStatus waits for LoadBalancer services to get an ingress address.
+// Services of other types are ready right away.
+func serviceStatus(object map[string]interface{}) (Status, error) {
+	if serviceType, _ := field(object, "spec", "type").(string); serviceType != "LoadBalancer" {
+		return Status{Ready: true}, nil
+	}
+	if ingress, _ := field(object, "status", "loadBalancer", "ingress").([]interface{}); len(ingress) > 0 {
+		return Status{Ready: true}, nil
+	}
+	return Status{Message: "waiting for load balancer ingress"}, nil
+}
+
+// findCondition returns the status of the condition of the given type in
+// status.conditions and the condition itself.
+func findCondition(object map[string]interface{}, conditionType string) (string, map[string]interface{}) {
+	conditions, _ := field(object, "status", "conditions").([]interface{})
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		status, _ := condition["status"].(string)
+		return status, condition
+	}
+	return "", nil
+}
+
+func conditionMessage(condition map[string]interface{}) string {
+	reason, _ := condition["reason"].(string)
+	message, _ := condition["message"].(string)
+	switch {
+	case reason != "" && message != "":
+		return reason + ": " + message
+	case reason != "":
+		return reason
+	case message != "":
+		return message
+	}
+	return "unknown reason"
+}
+
+// field returns the value at the given path of nested objects, or nil.
+func field(object map[string]interface{}, path ...string) interface{} {
+	var value interface{} = object
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// integer returns the number at the given path, or 0. JSON numbers are
+// decoded as float64.
+func integer(object map[string]interface{}, path ...string) int64 {
+	switch n := field(object, path...).(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
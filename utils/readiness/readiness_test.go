@@ -0,0 +1,93 @@
+package readiness
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func object(t *testing.T, s string) map[string]interface{} {
+	var o map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(s), &o))
+	return o
+}
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		kind      string
+		object    string
+		condition string
+		expected  Status
+	}{
+		{"deployment rolled out", "deployment", `{"metadata":{"generation":2},"spec":{"replicas":2},"status":{"observedGeneration":2,"replicas":2,"updatedReplicas":2,"availableReplicas":2}}`, "", Status{Ready: true}},
+		{"deployment not observed", "deploy", `{"metadata":{"generation":3},"spec":{"replicas":2},"status":{"observedGeneration":2,"replicas":2,"updatedReplicas":2,"availableReplicas":2,"conditions":[{"type":"Available","status":"True"}]}}`, "", Status{Message: "waiting for the rollout to be observed"}},
+		{"deployment updating", "deployments.apps", `{"metadata":{"generation":3},"spec":{"replicas":3},"status":{"observedGeneration":3,"replicas":4,"updatedReplicas":1,"availableReplicas":3}}`, "", Status{Message: "1 of 3 new replicas updated"}},
+		{"deployment old replicas", "deployment", `{"metadata":{"generation":3},"spec":{"replicas":3},"status":{"observedGeneration":3,"replicas":4,"updatedReplicas":3,"availableReplicas":3}}`, "", Status{Message: "1 old replicas pending termination"}},
+		{"deployment unavailable", "deployment", `{"metadata":{"generation":3},"spec":{"replicas":3},"status":{"observedGeneration":3,"replicas":3,"updatedReplicas":3,"availableReplicas":2}}`, "", Status{Message: "2 of 3 updated replicas available"}},
+		{"deployment scaled to zero", "deployment", `{"metadata":{"generation":4},"spec":{"replicas":0},"status":{"observedGeneration":4}}`, "", Status{Ready: true}},
+		{"daemonset rolled out", "DaemonSet", `{"metadata":{"generation":5},"status":{"observedGeneration":5,"desiredNumberScheduled":3,"updatedNumberScheduled":3,"numberAvailable":3,"numberReady":3}}`, "", Status{Ready: true}},
+		{"daemonset updating", "ds", `{"metadata":{"generation":5},"status":{"observedGeneration":5,"desiredNumberScheduled":3,"updatedNumberScheduled":1,"numberAvailable":3,"numberReady":3}}`, "", Status{Message: "1 of 3 new pods updated"}},
+		{"daemonset unavailable", "ds", `{"metadata":{"generation":5},"status":{"observedGeneration":5,"desiredNumberScheduled":3,"updatedNumberScheduled":3,"numberAvailable":2}}`, "", Status{Message: "2 of 3 updated pods available"}},
+		{"daemonset on delete", "ds", `{"metadata":{"generation":5},"spec":{"updateStrategy":{"type":"OnDelete"}},"status":{"observedGeneration":5,"desiredNumberScheduled":3,"updatedNumberScheduled":0,"numberAvailable":3}}`, "", Status{Ready: true}},
+		{"statefulset rolled out", "sts", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"replicas":3,"readyReplicas":3,"updatedReplicas":3,"currentRevision":"db-2","updateRevision":"db-2"}}`, "", Status{Ready: true}},
+		{"statefulset progressing", "statefulsets.apps", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"readyReplicas":1,"replicas":3}}`, "", Status{Message: "1 of 3 replicas ready"}},
+		{"statefulset old revision", "statefulset", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"replicas":3,"readyReplicas":3,"updatedReplicas":1,"currentRevision":"db-1","updateRevision":"db-2"}}`, "", Status{Message: "1 of 3 replicas updated to revision db-2"}},
+		{"statefulset partitioned", "statefulset", `{"metadata":{"generation":2},"spec":{"replicas":3,"updateStrategy":{"type":"RollingUpdate","rollingUpdate":{"partition":2}}},"status":{"observedGeneration":2,"replicas":3,"readyReplicas":3,"updatedReplicas":1,"currentRevision":"db-1","updateRevision":"db-2"}}`, "", Status{Ready: true}},
+		{"job complete", "job", `{"status":{"succeeded":1,"conditions":[{"type":"Complete","status":"True"}]}}`, "", Status{Ready: true}},
+		{"job running", "jobs", `{"status":{"active":1}}`, "", Status{Message: "1 active, 0 succeeded"}},
+		{"pvc bound", "pvc", `{"status":{"phase":"Bound"}}`, "", Status{Ready: true}},
+		{"pvc pending", "PersistentVolumeClaim", `{"status":{"phase":"Pending"}}`, "", Status{Message: "phase is Pending, waiting for Bound"}},
+		{"cluster ip service", "svc", `{"spec":{"type":"ClusterIP"}}`, "", Status{Ready: true}},
+		{"load balancer pending", "service", `{"spec":{"type":"LoadBalancer"},"status":{"loadBalancer":{}}}`, "", Status{Message: "waiting for load balancer ingress"}},
+		{"load balancer ready", "service", `{"spec":{"type":"LoadBalancer"},"status":{"loadBalancer":{"ingress":[{"ip":"10.0.0.1"}]}}}`, "", Status{Ready: true}},
+		{"crd established", "crd", `{"status":{"conditions":[{"type":"NamesAccepted","status":"True"},{"type":"Established","status":"True"}]}}`, "", Status{Ready: true}},
+		{"apiservice unavailable", "apiservice", `{"status":{"conditions":[{"type":"Available","status":"False"}]}}`, "", Status{Message: "waiting for condition Available=True"}},
+		{"custom resource ready", "certificates.cert-manager.io", `{"status":{"conditions":[{"type":"Ready","status":"True"}]}}`, "", Status{Ready: true}},
+		{"custom resource without status", "certificate", `{}`, "", Status{Message: "waiting for condition Ready=True"}},
+		{"custom condition", "kafka", `{"status":{"conditions":[{"type":"Ready","status":"True"},{"type":"Synced","status":"True"}]}}`, "Synced", Status{Ready: true}},
+		{"custom condition status", "node", `{"status":{"conditions":[{"type":"MemoryPressure","status":"False"}]}}`, "MemoryPressure=False", Status{Ready: true}},
+		{"condition replaces rule", "deployment", `{"status":{"conditions":[{"type":"Available","status":"True"}]}}`, "Progressing", Status{Message: "waiting for condition Progressing=True"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := Check(tc.kind, object(t, tc.object), tc.condition)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, status)
+		})
+	}
+}
+
+func TestCheckProgressDeadlineExceeded(t *testing.T) {
+	_, err := Check("deployment", object(t, `{"metadata":{"generation":2},"status":{"observedGeneration":2,"conditions":[{"type":"Progressing","status":"False","reason":"ProgressDeadlineExceeded","message":"ReplicaSet \"web-5d4\" has timed out progressing."}]}}`), "")
+	assert.EqualError(t, err, `rollout exceeded its progress deadline: ProgressDeadlineExceeded: ReplicaSet "web-5d4" has timed out progressing.`)
+}
+
+func TestCheckFailedJob(t *testing.T) {
+	_, err := Check("job", object(t, `{"status":{"failed":6,"conditions":[{"type":"Failed","status":"True","reason":"BackoffLimitExceeded","message":"Job has reached the specified backoff limit"}]}}`), "")
+	assert.EqualError(t, err, "job failed: BackoffLimitExceeded: Job has reached the specified backoff limit")
+}
+
+func TestParseCondition(t *testing.T) {
+	conditionType, status, err := ParseCondition("Ready")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Ready", "True"}, []string{conditionType, status})
+
+	conditionType, status, err = ParseCondition("Degraded = False")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Degraded", "False"}, []string{conditionType, status})
+
+	for _, condition := range []string{"", "=True", "Ready=", "Ready=True=False", "Not Ready"} {
+		_, _, err := ParseCondition(condition)
+		assert.Errorf(t, err, "expected %q to be invalid", condition)
+	}
+}
+
+func TestNormalizeKind(t *testing.T) {
+	assert.Equal(t, "deployment", NormalizeKind("deployments.apps"))
+	assert.Equal(t, "persistentvolumeclaim", NormalizeKind("PVC"))
+	assert.Equal(t, "certificate", NormalizeKind("Certificate"))
+	assert.True(t, HasRule("sts"))
+	assert.False(t, HasRule("certificates.cert-manager.io"))
+}
@@ -1,9 +1,9 @@
 package report
 
 import (
-	"fmt"
+	"encoding/csv"
 	"os"
-	"text/template"
+	"strings"
 )
 
 type Report struct {
@@ -25,13 +25,16 @@ type ReportDetail struct {
 	ChartsSource string
 	Overrides    string
 	ValueFiles   string
+	Status       string
+	Catalog      string
+	Divergence   string
 }
 
 func NewReport() Report {
 
 	return Report{
 		ReportFile:   "auditreport.csv",
-		ReportHeader: "Name,Cluster,Namespace,Version,ChartPath,ChartsSource,ValueFiles",
+		ReportHeader: "Name,Cluster,Namespace,Version,ChartPath,ChartsSource,ValueFiles,Status,Catalog,CatalogDivergence",
 		ReportLines:  make(map[ReportKey]ReportDetail),
 	}
 }
@@ -40,47 +43,43 @@ func (rpt *Report) Add(reportkey ReportKey, detail ReportDetail) {
 	rpt.ReportLines[reportkey] = detail
 }
 
+// Write writes the report as CSV. Fields are quoted as needed, e.g. the
+// when conditions of skipped releases, which may contain quotes and commas.
 func (rpt *Report) Write(fName string) error {
-	type reportline struct {
-		Name         string
-		Cluster      string
-		Namespace    string
-		Version      string
-		ChartPath    string
-		ChartsSource string
-		ValueFiles   string
-	}
 	fd, err := os.Create(fName)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
 
+	w := csv.NewWriter(fd)
 	// Report header
-	fmt.Fprintln(fd, rpt.ReportHeader)
+	if err := w.Write(strings.Split(rpt.ReportHeader, ",")); err != nil {
+		return err
+	}
 	for key, line := range rpt.ReportLines {
-		t, err := template.New("Report").Parse("{{.Name}},{{.Cluster}},{{.Namespace}},{{.Version}},{{.ChartPath}},{{.ChartsSource}},{{.ValueFiles}}\n")
-		if err != nil {
-			panic(err)
-		}
-		item := reportline{
-			Name:         key.Name,
-			Cluster:      key.Cluster,
-			Namespace:    key.Namespace,
-			Version:      line.Version,
-			ChartPath:    line.ChartPath,
-			ChartsSource: line.ChartsSource,
-			ValueFiles:   line.ValueFiles,
+		record := []string{
+			key.Name,
+			key.Cluster,
+			key.Namespace,
+			line.Version,
+			line.ChartPath,
+			line.ChartsSource,
+			line.ValueFiles,
+			line.Status,
+			line.Catalog,
+			line.Divergence,
 		}
-		err = t.Execute(fd, item)
-		if err != nil {
-			panic(err)
+		if err := w.Write(record); err != nil {
+			return err
 		}
-
 	}
-	fd.Sync()
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
 
-	return nil
+	return fd.Sync()
 }
 
 type Clusters struct {
@@ -1,9 +1,14 @@
 package report
 
 import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewReport(t *testing.T) {
@@ -15,6 +20,26 @@ func TestReport_Write(t *testing.T) {
 	rep := NewReport()
 	rep.Write("test.csv")
 }
+
+func TestReportWriteQuotesFields(t *testing.T) {
+	rep := NewReport()
+	rep.Add(ReportKey{Name: "west", Cluster: "lab", Namespace: "apps"}, ReportDetail{
+		Version: "1.0.0",
+		Status:  `skipped: cluster.vars.region == "us-west", or not`,
+	})
+	file := filepath.Join(t.TempDir(), "report.csv")
+	require.NoError(t, rep.Write(file))
+
+	fd, err := os.Open(file)
+	require.NoError(t, err)
+	defer fd.Close()
+	records, err := csv.NewReader(fd).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, strings.Split(rep.ReportHeader, ","), records[0])
+	assert.Equal(t, []string{"west", "lab", "apps", "1.0.0", "", "", "", `skipped: cluster.vars.region == "us-west", or not`, "", ""}, records[1])
+}
+
 func TestNewClusters(t *testing.T) {
 
 }
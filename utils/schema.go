@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/target/impeller/types"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// ClusterConfigSchema returns a JSON Schema for cluster config files. It is
+// generated from types.ClusterConfig using the same field rules as
+// ReadClusterConfig. Field descriptions come from `description` struct tags
+// and the `jsonschema` tag marks `required` fields and `oneof=<group>`
+// fields, of which exactly one per group must be set.
+func ClusterConfigSchema() ([]byte, error) {
+	return JSONSchema(reflect.TypeOf(types.ClusterConfig{}), "impeller cluster config")
+}
+
+// FleetConfigSchema returns a JSON Schema for fleet files.
+func FleetConfigSchema() ([]byte, error) {
+	return JSONSchema(reflect.TypeOf(types.FleetConfig{}), "impeller fleet file")
+}
+
+// JSONSchema returns the JSON Schema of a YAML document decoded into t.
+func JSONSchema(t reflect.Type, title string) ([]byte, error) {
+	g := schemaGenerator{definitions: map[string]interface{}{}}
+	root := g.schema(t)
+	root["$schema"] = jsonSchemaDraft
+	root["title"] = title
+	root["definitions"] = g.definitions
+	return json.MarshalIndent(root, "", "  ")
+}
+
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := g.definitions[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate.
+			g.definitions[t.Name()] = nil
+			g.definitions[t.Name()] = g.structSchema(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if hasShorthand(t) {
+			return map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "string"}, ref}}
+		}
+		return ref
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required, groupNames []string
+	groups := map[string][]string{}
+
+	for _, field := range yamlFields(t) {
+		property := g.schema(field.Field.Type)
+		if description := field.Field.Tag.Get("description"); description != "" {
+			if _, ok := property["$ref"]; ok {
+				// Keywords next to $ref are ignored by draft-07.
+				property = map[string]interface{}{"allOf": []interface{}{property}}
+			}
+			property["description"] = description
+		}
+		properties[field.Name] = property
+
+		for _, option := range strings.Split(field.Field.Tag.Get("jsonschema"), ",") {
+			switch {
+			case option == "required":
+				required = append(required, field.Name)
+			case strings.HasPrefix(option, "oneof="):
+				group := strings.TrimPrefix(option, "oneof=")
+				if _, ok := groups[group]; !ok {
+					groupNames = append(groupNames, group)
+				}
+				groups[group] = append(groups[group], field.Name)
+			}
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	var oneOfs []interface{}
+	for _, group := range groupNames {
+		var oneOf []interface{}
+		for _, name := range groups[group] {
+			oneOf = append(oneOf, map[string]interface{}{"required": []string{name}})
+		}
+		oneOfs = append(oneOfs, map[string]interface{}{"oneOf": oneOf})
+	}
+	switch len(oneOfs) {
+	case 0:
+	case 1:
+		schema["oneOf"] = oneOfs[0].(map[string]interface{})["oneOf"]
+	default:
+		schema["allOf"] = oneOfs
+	}
+	return schema
+}
@@ -0,0 +1,118 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	opEquals    = "="
+	opNotEquals = "!="
+	opExists    = "exists"
+	opNotExists = "!exists"
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+// Selector is a label selector in the style of `kubectl --selector`, a
+// comma-separated list of requirements which must all be met:
+//
+//	key=value, key==value  the label is set to value
+//	key!=value             the label is not set to value (or not set at all)
+//	key                    the label is set
+//	!key                   the label is not set
+type Selector struct {
+	requirements []requirement
+}
+
+type requirement struct {
+	key      string
+	operator string
+	value    string
+}
+
+// Parse parses a selector. An empty string selects everything.
+func Parse(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = requirement{key: kv[0], operator: opNotEquals, value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			req = requirement{key: kv[0], operator: opEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = requirement{key: kv[0], operator: opEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = requirement{key: part[1:], operator: opNotExists}
+		default:
+			req = requirement{key: part, operator: opExists}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !labelKeyPattern.MatchString(req.key) {
+			return Selector{}, fmt.Errorf("invalid selector \"%s\": invalid label key \"%s\"", s, req.key)
+		}
+		if strings.ContainsAny(req.value, "=!") {
+			return Selector{}, fmt.Errorf("invalid selector \"%s\": invalid label value \"%s\"", s, req.value)
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return sel, nil
+}
+
+// Empty reports whether the selector has no requirements.
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+// Matches reports whether labels meet all requirements of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		value, ok := labels[req.key]
+		switch req.operator {
+		case opEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s.requirements))
+	for i, req := range s.requirements {
+		switch req.operator {
+		case opExists:
+			parts[i] = req.key
+		case opNotExists:
+			parts[i] = "!" + req.key
+		default:
+			parts[i] = req.key + req.operator + req.value
+		}
+	}
+	return strings.Join(parts, ",")
+}
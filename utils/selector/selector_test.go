@@ -0,0 +1,41 @@
+package selector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAndMatch(t *testing.T) {
+	sel, err := Parse("tier=infra, team!=data,critical,!deprecated")
+	require.NoError(t, err)
+	assert.Equal(t, "tier=infra,team!=data,critical,!deprecated", sel.String())
+
+	assert.True(t, sel.Matches(map[string]string{"tier": "infra", "team": "platform", "critical": "true"}))
+	assert.True(t, sel.Matches(map[string]string{"tier": "infra", "critical": ""}))
+	assert.False(t, sel.Matches(map[string]string{"tier": "apps", "critical": "true"}))
+	assert.False(t, sel.Matches(map[string]string{"tier": "infra", "team": "data", "critical": "true"}))
+	assert.False(t, sel.Matches(map[string]string{"tier": "infra"}))
+	assert.False(t, sel.Matches(map[string]string{"tier": "infra", "critical": "true", "deprecated": "true"}))
+}
+
+func TestParseDoubleEquals(t *testing.T) {
+	sel, err := Parse("tier==infra")
+	require.NoError(t, err)
+	assert.True(t, sel.Matches(map[string]string{"tier": "infra"}))
+}
+
+func TestParseEmpty(t *testing.T) {
+	sel, err := Parse("")
+	require.NoError(t, err)
+	assert.True(t, sel.Empty())
+	assert.True(t, sel.Matches(nil))
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{"=infra", "tier=in=fra", "!", "ti er=infra"} {
+		_, err := Parse(s)
+		assert.Errorf(t, err, "expected %q to be invalid", s)
+	}
+}
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// validateYAML checks a YAML document against the Go type it is decoded
+// into. Every unknown key and every value of the wrong type is reported with
+// its file:line:column, unknown keys with the closest valid field name.
+// Scalars referencing variables, e.g. `history: ${HISTORY:-3}`, are only
+// checked once the variables are known, see validateYAMLVariables.
+func validateYAML(fileName string, data []byte, t reflect.Type) error {
+	v, err := runValidator(fileName, data, t, nil)
+	if err != nil || len(v.errs) == 0 {
+		return err
+	}
+	return fmt.Errorf("%d problem(s) found:\n  %s", len(v.errs), strings.Join(v.errs, "\n  "))
+}
+
+// validateYAMLVariables checks the type of every scalar of a YAML document
+// which references variables, with the references resolved by lookup.
+// Problems are reported at the line of the original value. Undefined
+// variables are left to interpolation to report.
+func validateYAMLVariables(fileName string, data []byte, t reflect.Type, lookup func(name string) (string, bool)) error {
+	v, err := runValidator(fileName, data, t, lookup)
+	if err != nil || len(v.variableErrs) == 0 {
+		return err
+	}
+	return fmt.Errorf("%d problem(s) found:\n  %s", len(v.variableErrs), strings.Join(v.variableErrs, "\n  "))
+}
+
+func runValidator(fileName string, data []byte, t reflect.Type, lookup func(name string) (string, bool)) (*validator, error) {
+	v := &validator{fileName: fileName, lookup: lookup}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return v, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(doc.Content) > 0 {
+		v.validate(doc.Content[0], t, "")
+	}
+	return v, nil
+}
+
+type validator struct {
+	fileName string
+	errs     []string
+
+	// lookup resolves variables; variableErrs holds the problems of
+	// scalars referencing them.
+	lookup       func(name string) (string, bool)
+	variableErrs []string
+}
+
+func (v *validator) errorf(node *yamlv3.Node, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Sprintf("%s:%d:%d: %s", v.fileName, node.Line, node.Column, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) validate(node *yamlv3.Node, t reflect.Type, path string) {
+	if node.Kind == yamlv3.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yamlv3.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind == yamlv3.ScalarNode && hasShorthand(t) {
+			return
+		}
+		if node.Kind != yamlv3.MappingNode {
+			v.errorf(node, "%s must be a mapping", describePath(path))
+			return
+		}
+		fields := yamlFieldTypes(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				if suggestion := closestName(key.Value, fields); suggestion != "" {
+					v.errorf(key, "unknown field \"%s\" in %s (did you mean \"%s\"?)", key.Value, describePath(path), suggestion)
+				} else {
+					v.errorf(key, "unknown field \"%s\" in %s", key.Value, describePath(path))
+				}
+				continue
+			}
+			v.validate(value, field, joinPath(path, key.Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yamlv3.SequenceNode {
+			v.errorf(node, "%s must be a list", describePath(path))
+			return
+		}
+		for i, item := range node.Content {
+			v.validate(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if node.Kind != yamlv3.MappingNode {
+			v.errorf(node, "%s must be a mapping", describePath(path))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.validate(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	case reflect.Interface:
+		return
+	default:
+		if node.Kind != yamlv3.ScalarNode {
+			v.errorf(node, "%s must be a %s value", describePath(path), t.Kind())
+			return
+		}
+		if t.Kind() != reflect.String && variablePattern.MatchString(node.Value) {
+			v.validateVariables(node, t, path)
+			return
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			v.errorf(node, "invalid value \"%s\" for %s: expected a %s value", node.Value, describePath(path), t.Kind())
+		}
+	}
+}
+
+// validateVariables checks a scalar referencing variables once lookup is
+// set, by decoding the interpolated value as a YAML scalar.
+func (v *validator) validateVariables(node *yamlv3.Node, t reflect.Type, path string) {
+	if v.lookup == nil {
+		return
+	}
+	value, undefined := Interpolate(node.Value, v.lookup)
+	if len(undefined) > 0 {
+		return
+	}
+	if err := yamlv3.Unmarshal([]byte(value), reflect.New(t).Interface()); err != nil || strings.TrimSpace(value) == "" {
+		v.variableErrs = append(v.variableErrs, fmt.Sprintf("%s:%d:%d: invalid value \"%s\" for %s, resolved from \"%s\": expected a %s value", v.fileName, node.Line, node.Column, value, describePath(path), node.Value, t.Kind()))
+	}
+}
+
+// coerceScalars converts the strings in a raw YAML tree which are decoded
+// into non-string scalar fields of t, e.g. "3" resolved from ${HISTORY:-3}
+// for a uint, into values of the field type. Values which do not convert
+// are left for the decoder to report.
+func coerceScalars(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := value.(map[interface{}]interface{}); ok {
+			fields := yamlFieldTypes(t)
+			for key, item := range m {
+				if field, ok := fields[fmt.Sprint(key)]; ok {
+					m[key] = coerceScalars(item, field)
+				}
+			}
+		}
+	case reflect.Map:
+		if m, ok := value.(map[interface{}]interface{}); ok {
+			for key, item := range m {
+				m[key] = coerceScalars(item, t.Elem())
+			}
+		}
+	case reflect.Slice:
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = coerceScalars(item, t.Elem())
+			}
+		}
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		if s, ok := value.(string); ok && strings.TrimSpace(s) != "" {
+			converted := reflect.New(t)
+			if err := yamlv3.Unmarshal([]byte(s), converted.Interface()); err == nil {
+				return converted.Elem().Interface()
+			}
+		}
+	}
+	return value
+}
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// hasShorthand reports whether a struct type decodes itself, which the
+// types of the config only do to also accept a string instead of a mapping,
+// e.g. types.WaitEntry.
+func hasShorthand(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && reflect.PtrTo(t).Implements(yamlUnmarshaler)
+}
+
+type yamlField struct {
+	Name  string
+	Field reflect.StructField
+}
+
+// yamlFields returns the YAML fields of a struct type in declaration order,
+// following the same rules as the yaml package: the key is the tag name, or
+// the lower-cased field name, and `inline` fields are flattened into their
+// parent.
+func yamlFields(t reflect.Type) (fields []yamlField) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range parts[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline {
+			fields = append(fields, yamlFields(field.Type)...)
+			continue
+		}
+		name := parts[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields = append(fields, yamlField{Name: name, Field: field})
+	}
+	return
+}
+
+func yamlFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fieldTypes := map[string]reflect.Type{}
+	for _, field := range yamlFields(t) {
+		fieldTypes[field.Name] = field.Field.Type
+	}
+	return fieldTypes
+}
+
+// closestName returns the field name closest to name, or "" if none is
+// close enough to be a likely typo.
+func closestName(name string, fields map[string]reflect.Type) string {
+	candidates := make([]string, 0, len(fields))
+	for candidate := range fields {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		distance := levenshtein(strings.ToLower(name), strings.ToLower(candidate))
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if bestDistance < 0 || bestDistance > 2+len(name)/4 {
+		return ""
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return "\"" + path + "\""
+}
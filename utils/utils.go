@@ -1,12 +1,17 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/target/impeller/types"
 	"github.com/target/impeller/utils/commandbuilder"
@@ -19,38 +24,259 @@ import (
 // stderr respectively. It allows printing the executed command and arguments,
 // but this can be disabled if the command contains secrets.
 func Run(cmd *exec.Cmd, showCommand bool) error {
+	return RunWithLogger(cmd, showCommand, log.Default())
+}
+
+// RunWithLogger is like Run but logs the executed command to the provided
+// logger. If the command's Stdout or Stderr is already set, it is kept.
+func RunWithLogger(cmd *exec.Cmd, showCommand bool, logger *log.Logger) error {
 	if showCommand {
 		quotedArgs := make([]string, len(cmd.Args))
 		for i, arg := range cmd.Args {
 			quotedArgs[i] = commandbuilder.ShellQuote(arg)
 		}
-		log.Printf("RUNNING: %s", strings.Join(quotedArgs, " "))
+		logger.Printf("RUNNING: %s", strings.Join(quotedArgs, " "))
 	} else {
-		log.Printf("RUNNING COMMAND: (command hidden)")
+		logger.Printf("RUNNING COMMAND: (command hidden)")
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
 	return cmd.Run()
 }
 
+// PrefixWriter is an io.Writer which prefixes every line written to it.
+// Lines are buffered until complete so output of concurrent commands sharing
+// the same underlying writer is not interleaved mid-line.
+type PrefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter writing to w.
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line.
+func (pw *PrefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	err := pw.writeLine(append(pw.buf, '\n'))
+	pw.buf = nil
+	return err
+}
+
+func (pw *PrefixWriter) writeLine(line []byte) error {
+	out := make([]byte, 0, len(pw.prefix)+len(line))
+	out = append(out, pw.prefix...)
+	out = append(out, line...)
+	_, err := pw.w.Write(out)
+	return err
+}
+
+// ReadClusterConfig reads a cluster config file. If the config `extends`
+// a base config, the base is read first (recursively) and the config is
+// merged into it, see mergeClusterConfigs. Variable references are resolved
+// afterwards, see interpolateClusterConfig. Numbers and booleans may reference
+// variables too, their type is checked once the references are resolved.
 func ReadClusterConfig(configPath string) (config types.ClusterConfig, err error) {
-	file, err := os.Open(configPath)
+	var sources []yamlSource
+	raw, err := readClusterConfigMap(configPath, nil, &sources)
+	if err != nil {
+		return
+	}
+	releasesDir, ok := raw["releasesDir"].(string)
+	if !ok || releasesDir == "" {
+		releasesDir = findReleaseCatalogDir(configPath)
+		raw["releasesDir"] = releasesDir
+	}
+	if err = resolveReleaseCatalog(raw, releasesDir, &sources); err != nil {
+		err = fmt.Errorf("Error reading config file \"%s\": %v", configPath, err)
+		return
+	}
+	if err = interpolateClusterConfig(raw); err != nil {
+		err = fmt.Errorf("Error interpolating config file \"%s\": %v", configPath, err)
+		return
+	}
+	vars := map[string]string{}
+	if resolved, ok := raw["vars"].(map[interface{}]interface{}); ok {
+		for key, value := range resolved {
+			vars[fmt.Sprint(key)] = fmt.Sprint(value)
+		}
+	}
+	for _, source := range sources {
+		if err = validateYAMLVariables(source.path, source.data, source.t, varLookup(vars)); err != nil {
+			err = fmt.Errorf("Error decoding config file: %v", err)
+			return
+		}
+	}
+	coerceScalars(raw, reflect.TypeOf(config))
+
+	out, err := yaml.Marshal(raw)
+	if err != nil {
+		err = fmt.Errorf("Error decoding config file: %v", err)
+		return
+	}
+	err = yaml.Unmarshal(out, &config)
+	if err != nil {
+		err = fmt.Errorf("Error decoding config file: %v", err)
+		return
+	}
+
+	releases := config.Releases[:0]
+	for _, release := range config.Releases {
+		if !release.Absent {
+			releases = append(releases, release)
+		}
+	}
+	config.Releases = releases
+
+	return
+}
+
+// yamlSource is a file read into a raw config, kept to check the values
+// referencing variables once the variables are known.
+type yamlSource struct {
+	path string
+	data []byte
+	t    reflect.Type
+}
+
+// readClusterConfigMap reads a cluster config file into a generic map and
+// resolves its `extends` chain. chain holds the files already being read and
+// is used to detect cycles. Every file read is added to sources.
+func readClusterConfigMap(configPath string, chain []string, sources *[]yamlSource) (map[interface{}]interface{}, error) {
+	configPath = filepath.Clean(configPath)
+	for _, path := range chain {
+		if path == configPath {
+			return nil, fmt.Errorf("Error reading config file: extends cycle detected: %s -> %s", strings.Join(chain, " -> "), configPath)
+		}
+	}
+	chain = append(chain, configPath)
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file \"%s\": %v", configPath, err)
+	}
+	if err := validateYAML(configPath, data, reflect.TypeOf(types.ClusterConfig{})); err != nil {
+		return nil, fmt.Errorf("Error decoding config file: %v", err)
+	}
+	*sources = append(*sources, yamlSource{path: configPath, data: data, t: reflect.TypeOf(types.ClusterConfig{})})
+
+	var raw map[interface{}]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	err = decoder.Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding config file: %v", err)
+	}
+
+	for _, key := range []string{"valuesDir", "releasesDir"} {
+		if dir, ok := raw[key].(string); ok && dir != "" && !filepath.IsAbs(dir) {
+			raw[key] = filepath.Join(filepath.Dir(configPath), dir)
+		}
+	}
+
+	extends, ok := raw["extends"]
+	if !ok {
+		return raw, nil
+	}
+	delete(raw, "extends")
+	basePath, ok := extends.(string)
+	if !ok || basePath == "" {
+		return nil, fmt.Errorf("Error decoding config file \"%s\": extends must be a file path", configPath)
+	}
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(configPath), basePath)
+	}
+
+	base, err := readClusterConfigMap(basePath, chain, sources)
+	if err != nil {
+		return nil, err
+	}
+	return mergeClusterConfigs(base, raw), nil
+}
+
+// ReadFleetConfig reads a fleet file mapping clusters to Kubernetes contexts.
+func ReadFleetConfig(configPath string) (config types.FleetConfig, err error) {
+	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		err = fmt.Errorf("Error opening file \"%s\": %v", configPath, err)
 		return
 	}
+	if err = validateYAML(configPath, data, reflect.TypeOf(config)); err != nil {
+		err = fmt.Errorf("Error decoding fleet file: %v", err)
+		return
+	}
 
-	decoder := yaml.NewDecoder(file)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	err = decoder.Decode(&config)
 	if err != nil {
-		err = fmt.Errorf("Error decoding config file: %v", err)
+		err = fmt.Errorf("Error decoding fleet file: %v", err)
 		return
 	}
 
 	return
 }
 
+// ListClusterConfigFiles expands the provided paths into cluster config
+// files. Files are returned as is, directories are expanded into the .yaml
+// and .yml files they contain, sorted by name.
+func ListClusterConfigFiles(paths []string) (files []string, err error) {
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening file \"%s\": %v", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		dirList, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening file \"%s\": %v", path, err)
+		}
+		for _, file := range dirList {
+			if !file.IsDir() && (strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml")) {
+				files = append(files, filepath.Join(path, file.Name()))
+			}
+		}
+	}
+	return
+}
+
 // ListClusters function lists cluster configuration files
 func ListClusters(configPath string) (cl report.Clusters, err error) {
 	cl = report.NewClusters()
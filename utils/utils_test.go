@@ -1,11 +1,18 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/target/impeller/types"
 )
 
 func TestReadConfigWithRepoCredentials(t *testing.T) {
@@ -51,3 +58,315 @@ func TestReadConfigWithSecrets(t *testing.T) {
 	assert.Equal(t, "USERNAME_ENV", release.Secrets[0].Data["username"])
 	assert.Equal(t, "PASSWORD_ENV", release.Secrets[0].Data["password"])
 }
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw := NewPrefixWriter(&out, "[release] ")
+
+	_, err := pw.Write([]byte("first line\nsecond "))
+	require.NoError(t, err)
+	assert.Equal(t, "[release] first line\n", out.String())
+
+	_, err = pw.Write([]byte("line\nunterminated"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Flush())
+	assert.Equal(t, "[release] first line\n[release] second line\n[release] unterminated\n", out.String())
+}
+
+func TestListClusterConfigFiles(t *testing.T) {
+	files, err := ListClusterConfigFiles([]string{"../test-clusters", "./tests/sample_config_overrides.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"../test-clusters/cluster1-lab.yaml",
+		"../test-clusters/cluster1-prod.yaml",
+		"../test-clusters/cluster1-test.yaml",
+		"../test-clusters/cluster2-lab.yaml",
+		"./tests/sample_config_overrides.yaml",
+	}, files)
+
+	_, err = ListClusterConfigFiles([]string{"./does-not-exist"})
+	require.Error(t, err)
+}
+
+func TestReadConfigExtends(t *testing.T) {
+	config, err := ReadClusterConfig("./tests/extends/cluster1-test.yaml")
+	require.NoError(t, err)
+
+	assert.Equal(t, "cluster1-test", config.Name)
+	assert.True(t, config.Helm.Debug)
+	assert.Equal(t, uint(3), config.Helm.DefaultHistory)
+	require.Len(t, config.Helm.Repos, 1)
+
+	require.Len(t, config.Releases, 4)
+	assert.Equal(t, "sample-server", config.Releases[0].Name)
+	assert.Equal(t, "2.0.0", config.Releases[0].Version)
+	assert.Equal(t, "stable/sample-server", config.Releases[0].ChartPath)
+	assert.Equal(t, []string{"values/sample-server/test.yaml"}, config.Releases[0].ValueFiles)
+	assert.Equal(t, []types.WaitEntry{{Name: "sample-server"}}, config.Releases[0].WaitforDeployment)
+	assert.Equal(t, "sample-ingress", config.Releases[1].Name)
+	assert.Equal(t, "sample-debug", config.Releases[2].Name)
+	assert.Equal(t, "sample-metrics", config.Releases[3].Name)
+}
+
+func TestReadConfigExtendsChained(t *testing.T) {
+	config, err := ReadClusterConfig("./tests/extends/cluster1-prod.yaml")
+	require.NoError(t, err)
+
+	assert.Equal(t, "cluster1-prod", config.Name)
+	assert.True(t, config.Helm.Debug)
+	require.Len(t, config.Releases, 3)
+	assert.Equal(t, "sample-server", config.Releases[0].Name)
+	assert.Equal(t, "2.9.0", config.Releases[0].Version)
+	assert.Equal(t, []string{"values/sample-server/test.yaml"}, config.Releases[0].ValueFiles)
+	assert.Equal(t, "sample-ingress", config.Releases[1].Name)
+	assert.Equal(t, "sample-metrics", config.Releases[2].Name)
+}
+
+func TestReadConfigExtendsCycle(t *testing.T) {
+	_, err := ReadClusterConfig("./tests/extends/cycle-a.yaml")
+	require.Error(t, err)
+	assert.Equal(t, "Error reading config file: extends cycle detected: tests/extends/cycle-a.yaml -> tests/extends/cycle-b.yaml -> tests/extends/cycle-a.yaml", err.Error())
+}
+
+func TestReadConfigStrict(t *testing.T) {
+	_, err := ReadClusterConfig("./tests/sample_config_typos.yaml")
+	require.Error(t, err)
+	assert.Equal(t, "Error decoding config file: 4 problem(s) found:\n"+
+		"  tests/sample_config_typos.yaml:3:19: invalid value \"three\" for \"helm.defaultHistory\": expected a uint value\n"+
+		"  tests/sample_config_typos.yaml:9:5: unknown field \"deploymentmethod\" in \"releases[0]\" (did you mean \"deploymentMethod\"?)\n"+
+		"  tests/sample_config_typos.yaml:10:5: unknown field \"waitforDaemonset\" in \"releases[0]\" (did you mean \"waitforDaemonSet\"?)\n"+
+		"  tests/sample_config_typos.yaml:15:9: unknown field \"valeu\" in \"releases[0].overrides[0]\" (did you mean \"value\"?)", err.Error())
+}
+
+func TestReadConfigStrictNoSuggestion(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "cluster.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("name: cluster\nsomethingElse: true\n"), 0o644))
+
+	_, err := ReadClusterConfig(configPath)
+	require.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), "cluster.yaml:2:1: unknown field \"somethingElse\" in config"), err.Error())
+}
+
+func TestClusterConfigSchema(t *testing.T) {
+	out, err := ClusterConfigSchema()
+	require.NoError(t, err)
+
+	var schema struct {
+		Schema      string `json:"$schema"`
+		Ref         string `json:"$ref"`
+		Definitions map[string]struct {
+			Properties           map[string]map[string]interface{} `json:"properties"`
+			Required             []string                          `json:"required"`
+			OneOf                []map[string][]string             `json:"oneOf"`
+			AdditionalProperties bool                              `json:"additionalProperties"`
+		} `json:"definitions"`
+	}
+	require.NoError(t, json.Unmarshal(out, &schema))
+	assert.Equal(t, "http://json-schema.org/draft-07/schema#", schema.Schema)
+	assert.Equal(t, "#/definitions/ClusterConfig", schema.Ref)
+
+	// Every field accepted by ReadClusterConfig is part of the schema.
+	for name, typ := range map[string]reflect.Type{
+		"ClusterConfig": reflect.TypeOf(types.ClusterConfig{}),
+		"Release":       reflect.TypeOf(types.Release{}),
+		"HelmConfig":    reflect.TypeOf(types.HelmConfig{}),
+		"Secret":        reflect.TypeOf(types.Secret{}),
+		"ConfigMap":     reflect.TypeOf(types.ConfigMap{}),
+		"WaitFor":       reflect.TypeOf(types.WaitFor{}),
+		"WaitEntry":     reflect.TypeOf(types.WaitEntry{}),
+		"Override":      reflect.TypeOf(types.Override{}),
+	} {
+		definition, ok := schema.Definitions[name]
+		require.Truef(t, ok, "missing definition %s", name)
+		assert.False(t, definition.AdditionalProperties)
+		for field := range yamlFieldTypes(typ) {
+			require.Containsf(t, definition.Properties, field, "%s.%s missing from schema", name, field)
+			assert.NotEmptyf(t, definition.Properties[field]["description"], "%s.%s has no description", name, field)
+		}
+	}
+
+	override := schema.Definitions["Override"]
+	assert.Equal(t, []string{"target"}, override.Required)
+	assert.Equal(t, []map[string][]string{{"required": {"value"}}, {"required": {"valueFrom"}}}, override.OneOf)
+	assert.Equal(t, map[string]interface{}{"type": "integer", "minimum": float64(0), "description": "Maximum number of release revisions kept by Helm"}, schema.Definitions["Release"].Properties["history"])
+	assert.Equal(t, map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "string"}, map[string]interface{}{"$ref": "#/definitions/WaitEntry"}}}, schema.Definitions["Release"].Properties["waitforStatefulSet"]["items"])
+}
+
+func TestInterpolate(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, ok := map[string]string{"REGION": "us-east", "EMPTY": ""}[name]
+		return value, ok
+	}
+
+	result, undefined := Interpolate("${REGION}/${EMPTY:-x}/${MISSING:-default}/$${REGION}/$REGION/${MISSING}", lookup)
+	assert.Equal(t, "us-east//default/${REGION}/$REGION/${MISSING}", result)
+	assert.Equal(t, []string{"MISSING"}, undefined)
+}
+
+func TestReadConfigWithVariables(t *testing.T) {
+	t.Setenv("UNITTEST_REPO_HOST", "charts.example.com")
+	t.Setenv("UNITTEST_SERVER_VERSION", "3.9.0")
+
+	config, err := ReadClusterConfig("./tests/sample_config_vars.yaml")
+	require.NoError(t, err)
+
+	assert.Equal(t, "cluster1-prod", config.Name)
+	assert.Equal(t, map[string]string{"CLUSTER": "cluster1", "REGION": "us-east", "ENVIRONMENT": "prod"}, config.Vars)
+	assert.Equal(t, "https://charts.example.com/charts/", config.Helm.Repos[0].URL)
+	release := config.Releases[0]
+	assert.Equal(t, "kube-system", release.Namespace)
+	assert.Equal(t, "3.9.0", release.Version)
+	assert.Equal(t, "us-east", *release.Overrides[0].Value.Value)
+	assert.Equal(t, "${NOT_INTERPOLATED}", *release.Overrides[1].Value.Value)
+}
+
+func TestReadConfigWithUndefinedVariable(t *testing.T) {
+	_, err := ReadClusterConfig("./tests/sample_config_vars_undefined.yaml")
+	require.Error(t, err)
+	assert.Equal(t, "Error interpolating config file \"./tests/sample_config_vars_undefined.yaml\": undefined variable \"UNITTEST_UNDEFINED_VERSION\" in \"releases[0].version\"", err.Error())
+}
+
+func TestReadConfigWithTypedVariables(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "cluster.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("name: cluster\n"+
+		"vars:\n"+
+		"  WAIT: \"true\"\n"+
+		"helm:\n"+
+		"  parallelism: ${UNITTEST_PARALLELISM:-2}\n"+
+		"releases:\n"+
+		"  - name: app\n"+
+		"    chartPath: repo/app\n"+
+		"    history: ${UNITTEST_HISTORY:-3}\n"+
+		"    waitForAll: ${WAIT}\n"), 0o644))
+
+	config, err := ReadClusterConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, config.Helm.Parallelism)
+	assert.Equal(t, uint(3), config.Releases[0].History)
+	assert.True(t, config.Releases[0].WaitForAll)
+
+	t.Setenv("UNITTEST_HISTORY", "three")
+	_, err = ReadClusterConfig(configPath)
+	require.Error(t, err)
+	assert.Equal(t, "Error decoding config file: 1 problem(s) found:\n"+
+		"  "+configPath+":9:14: invalid value \"three\" for \"releases[0].history\", resolved from \"${UNITTEST_HISTORY:-3}\": expected a uint value", err.Error())
+}
+
+func TestReadConfigWaitEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "cluster.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("name: cluster\n"+
+		"releases:\n"+
+		"  - name: elasticsearch\n"+
+		"    chartPath: elastic/elasticsearch\n"+
+		"    waitforDeployment:\n"+
+		"      - kibana\n"+
+		"    waitforStatefulSet:\n"+
+		"      - name: elasticsearch-master\n"+
+		"        timeout: 45m\n"+
+		"        pollInterval: 30s\n"), 0o644))
+
+	config, err := ReadClusterConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, []types.WaitEntry{{Name: "kibana"}}, config.Releases[0].WaitforDeployment)
+	assert.Equal(t, []types.WaitEntry{{Name: "elasticsearch-master", Timeout: "45m", PollInterval: "30s"}}, config.Releases[0].WaitforStatefulSet)
+
+	require.NoError(t, os.WriteFile(configPath, []byte("name: cluster\n"+
+		"releases:\n"+
+		"  - name: elasticsearch\n"+
+		"    waitforStatefulSet:\n"+
+		"      - name: elasticsearch-master\n"+
+		"        timout: 45m\n"+
+		"      - [elasticsearch-data]\n"), 0o644))
+	_, err = ReadClusterConfig(configPath)
+	require.Error(t, err)
+	assert.Equal(t, "Error decoding config file: 2 problem(s) found:\n"+
+		"  "+configPath+":6:9: unknown field \"timout\" in \"releases[0].waitforStatefulSet[0]\" (did you mean \"timeout\"?)\n"+
+		"  "+configPath+":7:9: \"releases[0].waitforStatefulSet[1]\" must be a mapping", err.Error())
+}
+
+func TestReadConfigWithReleaseCatalog(t *testing.T) {
+	t.Chdir("./tests/catalog")
+
+	config, err := ReadClusterConfig("clusters/cluster1.yaml")
+	require.NoError(t, err)
+	require.Len(t, config.Releases, 2)
+
+	release := config.Releases[0]
+	assert.Equal(t, "cert-manager", release.Name)
+	assert.Equal(t, "cert-manager", release.From)
+	assert.Equal(t, "jetstack/cert-manager", release.ChartPath)
+	assert.Equal(t, "1.14.0", release.Version)
+	assert.Equal(t, "cert-manager", release.Namespace)
+	assert.Equal(t, []types.WaitEntry{{Name: "cert-manager"}, {Name: "cert-manager-webhook"}}, release.WaitforDeployment)
+	require.Len(t, release.Overrides, 2)
+	assert.Equal(t, "installCRDs", release.Overrides[0].Target)
+	assert.Equal(t, "replicaCount", release.Overrides[1].Target)
+	assert.Equal(t, "3", *release.Overrides[1].Value.Value)
+
+	assert.Equal(t, "releases", filepath.Base(config.ReleasesDir))
+	catalog, err := ReadReleaseCatalog(config, "cert-manager")
+	require.NoError(t, err)
+	assert.Equal(t, catalog.Version, config.Releases[1].Version)
+	assert.Equal(t, catalog.Overrides, config.Releases[1].Overrides)
+	assert.Equal(t, "cert-manager-default", config.Releases[1].Name)
+}
+
+func TestReadConfigWithReleaseCatalogErrors(t *testing.T) {
+	t.Chdir("./tests/catalog")
+
+	_, err := ReadClusterConfig("clusters/invalid-key.yaml")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `release "cert-manager": chartPath, waitforDeployment cannot be set for a release from the catalog, only absent, dependsOn, enabled, from, labels, name, namespace, overrides, values, version, when can be set`)
+
+	_, err = ReadClusterConfig("clusters/unknown.yaml")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `release "ingress": Error opening release catalog "ingress"`)
+
+	_, err = ReadReleaseCatalog(types.ClusterConfig{ReleasesDir: "releases"}, "../clusters/cluster1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid release catalog name")
+}
+
+func TestReadConfigWithReleaseCatalogOutsideWorkingDirectory(t *testing.T) {
+	config, err := ReadClusterConfig("./tests/catalog/clusters/cluster1.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "jetstack/cert-manager", config.Releases[0].ChartPath)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "clusters"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "catalog"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "catalog", "app.yaml"), []byte("name: app\nchartPath: repo/app\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clusters", "c.yaml"), []byte("name: c\nreleasesDir: ../catalog\nreleases:\n  - name: app\n    from: app\n"), 0o644))
+	config, err = ReadClusterConfig(filepath.Join(dir, "clusters", "c.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "catalog"), config.ReleasesDir)
+	assert.Equal(t, "repo/app", config.Releases[0].ChartPath)
+}
+
+func TestReadReleaseCatalogInterpolated(t *testing.T) {
+	config, err := ReadClusterConfig("./tests/catalog/clusters/interpolated.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "4.8.0", config.Releases[0].Version)
+	assert.Equal(t, "ingress", config.Releases[0].Namespace)
+	assert.Equal(t, uint(5), config.Releases[0].History)
+
+	catalog, err := ReadReleaseCatalog(config, "ingress-nginx")
+	require.NoError(t, err)
+	assert.Equal(t, "4.8.0", catalog.Version)
+	assert.Equal(t, "ingress", catalog.Namespace)
+	assert.Equal(t, uint(5), catalog.History)
+}
+
+func TestReadConfigValuesDirRelativeToConfigFile(t *testing.T) {
+	config, err := ReadClusterConfig("./tests/values-dir/clusters/cluster1.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("tests", "values"), config.ValuesDir)
+	assert.Equal(t, []string{"prod", "us-east"}, config.Groups)
+
+	config, err = ReadClusterConfig("./tests/values-dir/clusters/cluster2.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("tests", "values-dir", "clusters", "values"), config.ValuesDir)
+}
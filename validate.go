@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/target/impeller/types"
+	"github.com/target/impeller/utils"
+
+	"github.com/urfave/cli"
+)
+
+// Problem is an issue found in a cluster config by `impeller validate`.
+type Problem struct {
+	File    string `json:"file"`
+	Release string `json:"release,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Release == "" {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s: release \"%s\": %s", p.File, p.Release, p.Message)
+}
+
+var validateCommand = cli.Command{
+	Name:      "validate",
+	Usage:     "Check cluster configs for problems without connecting to a cluster",
+	ArgsUsage: "[cluster config files or directories...]",
+	Action:    runValidate,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "cluster-config-path",
+			Usage:  "Path to a cluster config or a directory of cluster configs",
+			EnvVar: "CLUSTER_CONFIG,PLUGIN_CLUSTER_CONFIG,PARAMETER_CLUSTER_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Output format: text or json",
+			Value: "text",
+		},
+	},
+}
+
+func runValidate(ctx *cli.Context) error {
+	paths := []string(ctx.Args())
+	if ctx.String("cluster-config-path") != "" {
+		paths = append(paths, strings.Split(ctx.String("cluster-config-path"), ",")...)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("Cluster config path not set.")
+	}
+	if ctx.String("output") != "text" && ctx.String("output") != "json" {
+		return fmt.Errorf("unsupported output format \"%s\"", ctx.String("output"))
+	}
+
+	files, err := utils.ListClusterConfigFiles(paths)
+	if err != nil {
+		return fmt.Errorf("Error reading cluster config: %v", err)
+	}
+
+	problems := []Problem{}
+	for _, file := range files {
+		problems = append(problems, validateClusterConfigFile(file)...)
+	}
+
+	if err := writeProblems(os.Stdout, ctx.String("output"), problems); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found in %d cluster config(s)", len(problems), len(files))
+	}
+	return nil
+}
+
+func writeProblems(w io.Writer, format string, problems []Problem) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(problems)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	return nil
+}
+
+func validateClusterConfigFile(file string) []Problem {
+	config, err := utils.ReadClusterConfig(file)
+	if err != nil {
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	return validateClusterConfig(file, config)
+}
+
+// validateClusterConfig runs all static checks on a cluster config.
+func validateClusterConfig(file string, config types.ClusterConfig) (problems []Problem) {
+	report := func(release, format string, args ...interface{}) {
+		problems = append(problems, Problem{File: file, Release: release, Message: fmt.Sprintf(format, args...)})
+	}
+
+	repos := map[string]bool{}
+	for _, repo := range config.Helm.Repos {
+		repos[repo.Name] = true
+	}
+
+	for _, layer := range config.ValuesLayers {
+		switch layer {
+		case "default", "valueFiles", "groups", "cluster":
+		default:
+			report("", "invalid valuesLayers entry \"%s\", must be one of %s", layer, strings.Join(types.DefaultValuesLayers, ", "))
+		}
+	}
+	if _, err := config.Helm.WaitTimeout.Get(); err != nil {
+		report("", "helm.waitTimeout: %v", err)
+	}
+	if _, err := config.Helm.PollInterval.Get(); err != nil {
+		report("", "helm.pollInterval: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, release := range config.Releases {
+		key := release.Namespace + "/" + release.Name
+		if seen[key] {
+			report(release.Name, "duplicate release name in namespace \"%s\"", release.Namespace)
+		}
+		seen[key] = true
+
+		switch release.DeploymentMethod {
+		case "", "helm":
+		case "kubectl":
+			if config.Helm.Upgrade != nil && !*config.Helm.Upgrade {
+				report(release.Name, "helm.upgrade false is not supported for releases with deploymentMethod kubectl")
+			}
+		default:
+			report(release.Name, "invalid deploymentMethod \"%s\", must be \"helm\" or \"kubectl\"", release.DeploymentMethod)
+		}
+
+		if release.ChartPath == "" {
+			report(release.Name, "chartPath is empty")
+		} else if repo := chartRepo(release); repo != "" && !config.Helm.SkipSetupHelmRepo && !repos[repo] {
+			report(release.Name, "chartPath \"%s\" uses repo \"%s\" which is not declared in helm.repos", release.ChartPath, repo)
+		}
+
+		if _, _, err := releaseEnabled(config, release); err != nil {
+			report(release.Name, "%v", err)
+		}
+
+		for _, override := range release.Overrides {
+			if err := override.Validate(); err != nil {
+				report(release.Name, "override %v", err)
+			}
+		}
+
+		if !validVersionConstraint(release.Version) {
+			report(release.Name, "malformed version constraint \"%s\"", release.Version)
+		}
+
+		for _, secret := range release.Secrets {
+			for key, envVarName := range secret.Data {
+				if !strings.HasSuffix(strings.TrimSpace(envVarName), "_ENV") {
+					report(release.Name, "secret \"%s\" key \"%s\": value \"%s\" must be an environment variable name ending with _ENV", secret.Name, key, envVarName)
+				}
+			}
+			if err := secret.Validate(); err != nil {
+				report(release.Name, "secret \"%s\": %v", secret.Name, err)
+			}
+			for key, valueFrom := range secret.DataFrom {
+				if _, err := valueFrom.Provider(); err != nil {
+					report(release.Name, "secret \"%s\" key \"%s\": %v", secret.Name, key, err)
+				}
+			}
+		}
+
+		if _, err := release.WaitTimeout.Get(); err != nil {
+			report(release.Name, "waitTimeout: %v", err)
+		}
+		if _, err := release.PollInterval.Get(); err != nil {
+			report(release.Name, "pollInterval: %v", err)
+		}
+
+		for _, list := range []struct {
+			field, kind string
+			entries     []types.WaitEntry
+		}{
+			{"waitforDeployment", "deployment", release.WaitforDeployment},
+			{"waitforDaemonSet", "daemonset", release.WaitforDaemonSet},
+			{"waitforStatefulSet", "statefulset", release.WaitforStatefulSet},
+		} {
+			for _, entry := range list.entries {
+				if err := entry.WaitFor(list.kind).Validate(); err != nil {
+					report(release.Name, "%s \"%s\": %v", list.field, entry.Name, err)
+				}
+			}
+		}
+
+		for _, wait := range release.WaitFor {
+			if err := wait.Validate(); err != nil {
+				report(release.Name, "waitFor %s \"%s\": %v", wait.Kind, wait.Name, err)
+			}
+		}
+
+		for _, configMap := range release.ConfigMaps {
+			if err := configMap.Validate(); err != nil {
+				report(release.Name, "configmap \"%s\": %v", configMap.Name, err)
+			}
+			for key, valueFrom := range configMap.DataFrom {
+				if _, err := valueFrom.Provider(); err != nil {
+					report(release.Name, "configmap \"%s\" key \"%s\": %v", configMap.Name, key, err)
+				}
+			}
+			for _, dir := range configMap.Directories {
+				if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+					report(release.Name, "configmap \"%s\" directory \"%s\" does not exist", configMap.Name, dir)
+				}
+			}
+		}
+
+		for _, path := range release.ValueFiles {
+			if _, err := os.Stat(path); err != nil {
+				report(release.Name, "value file \"%s\" does not exist", path)
+			}
+		}
+
+		for _, path := range release.KubectlFiles {
+			if _, err := os.Stat(path); err != nil {
+				report(release.Name, "kubectl file \"%s\" does not exist", path)
+			}
+		}
+	}
+
+	if _, err := releaseGraph(config.Releases); err != nil {
+		report("", "%v", err)
+	}
+
+	return problems
+}
+
+// chartRepo returns the Helm repo name a chartPath refers to, or "" if the
+// chart is not installed from a repo, e.g. a local path or an OCI reference.
+func chartRepo(release types.Release) string {
+	path := release.ChartPath
+	if release.ChartsSource != "" || strings.Contains(path, "://") ||
+		strings.HasPrefix(path, ".") || strings.HasPrefix(path, "/") {
+		return ""
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+var (
+	versionPattern     = `v?(\d+|[xX*])(\.(\d+|[xX*])){0,2}(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?`
+	constraintPattern  = regexp.MustCompile(`^(=|!=|>=|=>|<=|=<|>|<|~>?|\^)?\s*` + versionPattern + `$`)
+	hyphenPattern      = regexp.MustCompile(`^` + versionPattern + `\s+-\s+` + versionPattern + `$`)
+	andSplitPattern    = regexp.MustCompile(`\s*,\s*|\s+`)
+	operatorGapPattern = regexp.MustCompile(`(=|!=|>=|=>|<=|=<|>|<|~>?|\^)\s+`)
+)
+
+// validVersionConstraint reports whether version is a valid Helm --version
+// constraint, e.g. "1.2.3", "~1.x", ">=1.0.0, <2.0.0" or "1.2 - 1.4 || ^2".
+// An empty version means the latest version and is valid.
+func validVersionConstraint(version string) bool {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return true
+	}
+	for _, group := range strings.Split(version, "||") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			return false
+		}
+		if hyphenPattern.MatchString(group) {
+			continue
+		}
+		group = operatorGapPattern.ReplaceAllString(group, "$1")
+		for _, constraint := range andSplitPattern.Split(group, -1) {
+			if !constraintPattern.MatchString(constraint) {
+				return false
+			}
+		}
+	}
+	return true
+}
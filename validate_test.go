@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/target/impeller/types"
+)
+
+func TestValidateClusterConfig(t *testing.T) {
+	tempDir := t.TempDir()
+	valueFile := filepath.Join(tempDir, "values.yaml")
+	require.NoError(t, os.WriteFile(valueFile, []byte("replicas: 1"), 0o644))
+
+	invalidJSON := "{zones: [}"
+	config := types.ClusterConfig{
+		ValuesLayers: []string{"default", "region"},
+		Helm: types.HelmConfig{
+			WaitTimeout: "-5m",
+			Repos:       []types.HelmRepo{{Name: "stable"}},
+		},
+		Releases: []types.Release{
+			{Name: "valid", ChartPath: "stable/valid", Version: "~1.x", ValueFiles: []string{valueFile}},
+			{Name: "valid", ChartPath: "stable/valid", Namespace: "other"},
+			{Name: "duplicate", ChartPath: "./charts/duplicate"},
+			{Name: "duplicate", ChartPath: "./charts/duplicate"},
+			{Name: "no-chart"},
+			{Name: "bad-method", ChartPath: "stable/bad-method", DeploymentMethod: "kubect1"},
+			{Name: "unknown-repo", ChartPath: "private/unknown-repo", Version: "1.0.0 || >=2.x"},
+			{Name: "bad-condition", ChartPath: "stable/bad-condition", When: `cluster.vars.zone == "a"`},
+			{Name: "bad-override", ChartPath: "stable/bad-override", Overrides: []types.Override{{Target: "a", As: "number"}, {Target: "b", As: "json", Value: types.Value{Value: &invalidJSON}}}},
+			{Name: "bad-version", ChartPath: "stable/bad-version", Version: "1..2"},
+			{Name: "bad-secret", ChartPath: "stable/bad-secret", Secrets: []types.Secret{{Name: "creds", Data: map[string]string{"password": "hunter2"}}}},
+			{Name: "bad-wait", ChartPath: "stable/bad-wait", PollInterval: "often", WaitforStatefulSet: []types.WaitEntry{{Name: "db", Timeout: "soon"}}, WaitFor: []types.WaitFor{{Kind: "job"}, {Kind: "certificate", Name: "web-tls", Condition: "Ready=True=False"}, {Kind: "job", Name: "migrate", Timeout: "0s"}}},
+			{Name: "bad-configmap", ChartPath: "stable/bad-configmap", ConfigMaps: []types.ConfigMap{{Name: "settings", Directories: []string{"missing-config"}}, {Name: "empty"}}},
+			{Name: "missing-files", ChartPath: "stable/missing-files", ValueFiles: []string{"missing.yaml"}, KubectlFiles: []string{"missing-manifests"}},
+			{Name: "bad-dependency", ChartPath: "stable/bad-dependency", DependsOn: []string{"does-not-exist"}},
+		},
+	}
+
+	var messages []string
+	for _, problem := range validateClusterConfig("cluster.yaml", config) {
+		messages = append(messages, problem.String())
+	}
+	assert.Equal(t, []string{
+		`cluster.yaml: invalid valuesLayers entry "region", must be one of default, valueFiles, groups, cluster`,
+		`cluster.yaml: helm.waitTimeout: invalid duration "-5m", must be positive, e.g. 90s or 10m`,
+		`cluster.yaml: release "duplicate": duplicate release name in namespace ""`,
+		`cluster.yaml: release "no-chart": chartPath is empty`,
+		`cluster.yaml: release "bad-method": invalid deploymentMethod "kubect1", must be "helm" or "kubectl"`,
+		`cluster.yaml: release "unknown-repo": chartPath "private/unknown-repo" uses repo "private" which is not declared in helm.repos`,
+		`cluster.yaml: release "bad-condition": invalid condition "cluster.vars.zone == "a"": undefined identifier "cluster.vars.zone"`,
+		`cluster.yaml: release "bad-override": override invalid as "number" for "a", must be auto, string, json or literal`,
+		`cluster.yaml: release "bad-override": override value of "b" is not valid JSON`,
+		`cluster.yaml: release "bad-version": malformed version constraint "1..2"`,
+		`cluster.yaml: release "bad-secret": secret "creds" key "password": value "hunter2" must be an environment variable name ending with _ENV`,
+		`cluster.yaml: release "bad-wait": pollInterval: invalid duration "often", must be positive, e.g. 90s or 10m`,
+		`cluster.yaml: release "bad-wait": waitforStatefulSet "db": timeout: invalid duration "soon", must be positive, e.g. 90s or 10m`,
+		`cluster.yaml: release "bad-wait": waitFor job "": kind and name are required`,
+		`cluster.yaml: release "bad-wait": waitFor certificate "web-tls": invalid condition "Ready=True=False", must be <type> or <type>=<status>`,
+		`cluster.yaml: release "bad-wait": waitFor job "migrate": timeout: invalid duration "0s", must be positive, e.g. 90s or 10m`,
+		`cluster.yaml: release "bad-configmap": configmap "settings" directory "missing-config" does not exist`,
+		`cluster.yaml: release "bad-configmap": configmap "empty": no data`,
+		`cluster.yaml: release "missing-files": value file "missing.yaml" does not exist`,
+		`cluster.yaml: release "missing-files": kubectl file "missing-manifests" does not exist`,
+		`cluster.yaml: release "bad-dependency" depends on unknown release "does-not-exist"`,
+	}, messages)
+}
+
+func TestValidateClusterConfigFileDecodeError(t *testing.T) {
+	problems := validateClusterConfigFile("./does-not-exist.yaml")
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Message, "Error opening file")
+}
+
+func TestValidVersionConstraint(t *testing.T) {
+	for _, version := range []string{"", "1.2.3", "v1.2.3", "~x.x.x", "~1.x", "^2", "1.2.3-rc.1+build.5", ">=1.0.0, <2.0.0", ">= 1.0 < 2", "1.2 - 1.4.5", "1.x || ^2.1"} {
+		assert.Truef(t, validVersionConstraint(version), "expected %q to be valid", version)
+	}
+	for _, version := range []string{"1..2", "latest", ">>1.0", "1.2.3.4", "1.0 ||", "~"} {
+		assert.Falsef(t, validVersionConstraint(version), "expected %q to be invalid", version)
+	}
+}
+
+func TestWriteProblemsJSON(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, writeProblems(&out, "json", []Problem{{File: "cluster.yaml", Release: "app", Message: "chartPath is empty"}}))
+	assert.JSONEq(t, `[{"file": "cluster.yaml", "release": "app", "message": "chartPath is empty"}]`, out.String())
+}
+
+func TestValidateUpgradeFalseWithKubectl(t *testing.T) {
+	disabled := false
+	config := types.ClusterConfig{
+		Helm: types.HelmConfig{Upgrade: &disabled},
+		Releases: []types.Release{
+			{Name: "helm", ChartPath: "./charts/helm"},
+			{Name: "manifests", ChartPath: "./charts/manifests", DeploymentMethod: "kubectl"},
+		},
+	}
+	problems := validateClusterConfig("cluster.yaml", config)
+	require.Len(t, problems, 1)
+	assert.Equal(t, `cluster.yaml: release "manifests": helm.upgrade false is not supported for releases with deploymentMethod kubectl`, problems[0].String())
+}